@@ -0,0 +1,214 @@
+package backend
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCacheTTLs are the cache durations of the API responses by endpoint.
+// The clan rosters and memberships (clans/info, clans/list, clans/accountinfo) are never cached, the exits are detected from them.
+var DefaultCacheTTLs = map[string]time.Duration{
+	"/wows/account/info/":       time.Hour,
+	"/wows/ships/stats/":        24 * time.Hour,
+	"/wows/encyclopedia/ships/": 24 * time.Hour,
+	"/wows/clans/accountinfo/":  0,
+	"/wows/clans/info/":         0,
+	"/wows/clans/list/":         0,
+}
+
+// cacheEntry is a successful API response, it's also the format of the files of the on-disk cache
+type cacheEntry struct {
+	Key     string    `json:"key"`
+	Expires time.Time `json:"expires"`
+	Body    []byte    `json:"body"`
+}
+
+// APICache keeps the successful responses of the Wargaming API, so repeated lookups don't cost requests
+type APICache struct {
+	ttls       map[string]time.Duration
+	maxEntries int
+	// Directory of the on-disk cache, the cache is only in memory if empty
+	dir string
+
+	lock    sync.Mutex
+	entries map[string]cacheEntry
+}
+
+// NewAPICache creates a cache of the API responses, only the endpoints with a positive TTL are cached
+func NewAPICache(ttls map[string]time.Duration, maxEntries int, dir string) (*APICache, error) {
+	if dir != "" {
+		err := os.MkdirAll(dir, 0o700)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &APICache{
+		ttls:       ttls,
+		maxEntries: maxEntries,
+		dir:        dir,
+		entries:    make(map[string]cacheEntry),
+	}, nil
+}
+
+// cacheKey identifies a request by realm, endpoint and parameters, whatever the application ID used
+func cacheKey(req *http.Request) string {
+	query := req.URL.Query()
+	query.Del("application_id")
+	return req.URL.Host + endpointPath(req) + "?" + query.Encode()
+}
+
+func (cache *APICache) ttl(req *http.Request) time.Duration {
+	if req.Method != http.MethodGet {
+		return 0
+	}
+	return cache.ttls[endpointPath(req)]
+}
+
+func (cache *APICache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(cache.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// get returns the cached response body of a request, nil if it's not cached or expired
+func (cache *APICache) get(req *http.Request) []byte {
+	if cache.ttl(req) <= 0 {
+		return nil
+	}
+	key := cacheKey(req)
+	now := time.Now()
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	entry, ok := cache.entries[key]
+	if !ok && cache.dir != "" {
+		// Saved by a previous run
+		entry, ok = cache.load(key)
+		if ok && !now.After(entry.Expires) {
+			cache.put(entry)
+		}
+	}
+	if !ok || now.After(entry.Expires) {
+		return nil
+	}
+	return entry.Body
+}
+
+// set caches the response body of a request
+func (cache *APICache) set(req *http.Request, body []byte) {
+	ttl := cache.ttl(req)
+	if ttl <= 0 {
+		return
+	}
+	entry := cacheEntry{Key: cacheKey(req), Expires: time.Now().Add(ttl), Body: body}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.put(entry)
+	if cache.dir != "" {
+		// The cache is best effort, a response not saved is only fetched again by the next run
+		_ = cache.save(entry)
+	}
+}
+
+// put adds an entry in memory, making room for it if needed
+func (cache *APICache) put(entry cacheEntry) {
+	if _, ok := cache.entries[entry.Key]; !ok && len(cache.entries) >= cache.maxEntries {
+		cache.purgeMemory(time.Now())
+		for key := range cache.entries {
+			if len(cache.entries) < cache.maxEntries {
+				break
+			}
+			delete(cache.entries, key)
+		}
+	}
+	cache.entries[entry.Key] = entry
+}
+
+func (cache *APICache) load(key string) (cacheEntry, bool) {
+	var entry cacheEntry
+	data, err := os.ReadFile(cache.path(key))
+	if err != nil {
+		return entry, false
+	}
+	if json.Unmarshal(data, &entry) != nil || entry.Key != key {
+		return entry, false
+	}
+	return entry, true
+}
+
+// save writes an entry on disk, through a temporary file so an interrupted write is never read
+func (cache *APICache) save(entry cacheEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	path := cache.path(entry.Key)
+	err = os.WriteFile(path+".tmp", data, 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (cache *APICache) purgeMemory(now time.Time) int {
+	count := 0
+	for key, entry := range cache.entries {
+		if now.After(entry.Expires) {
+			delete(cache.entries, key)
+			count++
+		}
+	}
+	return count
+}
+
+// Purge removes the expired responses from memory and disk, it returns the number of responses removed
+func (cache *APICache) Purge() (int, error) {
+	now := time.Now()
+	cache.lock.Lock()
+	count := cache.purgeMemory(now)
+	cache.lock.Unlock()
+	if cache.dir == "" {
+		return count, nil
+	}
+
+	// The responses in memory are also on disk, only the files are counted
+	count = 0
+
+	files, err := os.ReadDir(cache.dir)
+	if err != nil {
+		return count, err
+	}
+	var errs []string
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(cache.dir, file.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		var entry cacheEntry
+		// Unreadable files are removed too
+		if json.Unmarshal(data, &entry) == nil && !now.After(entry.Expires) {
+			continue
+		}
+		err = os.Remove(path)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		count++
+	}
+	if len(errs) != 0 {
+		return count, errors.New(strings.Join(errs, "; "))
+	}
+	return count, nil
+}
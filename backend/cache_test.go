@@ -0,0 +1,132 @@
+package backend
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// apiTransport answers every request with an empty successful response, it counts the requests by endpoint
+type apiTransport struct {
+	requests map[string]int
+}
+
+func (transport *apiTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport.requests[endpointPath(req)]++
+	return cachedResponse(req, []byte(`{"status":"ok","meta":{"count":0},"data":{}}`)), nil
+}
+
+// testBackend returns a backend sending its requests to an apiTransport, through the cache if set
+func testBackend(t *testing.T, cache *APICache) (*Backend, *apiTransport) {
+	t.Helper()
+	backend, err := NewBackend([]string{"key"}, "eu", time.Second, nil, zap.NewNop().Sugar(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &apiTransport{requests: make(map[string]int)}
+	backend.SetAPITransport(transport)
+	if cache != nil {
+		backend.SetAPICache(cache)
+	}
+	return backend, transport
+}
+
+func TestEndpointPath(t *testing.T) {
+	tests := []struct {
+		url      string
+		endpoint string
+	}{
+		{"https://api.worldofwarships.eu/wows//account/info/?account_id=1", "/wows/account/info/"},
+		{"https://api.worldofwarships.eu/wows/clans/info/", "/wows/clans/info/"},
+		{"https://api.worldofwarships.eu/wows///ships/stats/", "/wows/ships/stats/"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(http.MethodGet, test.url, nil)
+		if endpoint := endpointPath(req); endpoint != test.endpoint {
+			t.Errorf("endpointPath(%s) = %s, expected %s", test.url, endpoint, test.endpoint)
+		}
+	}
+}
+
+// The TTLs are looked up with the paths built by the API client
+func TestCacheTTLClientPaths(t *testing.T) {
+	cache, err := NewAPICache(DefaultCacheTTLs, 100, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, transport := testBackend(t, cache)
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		// account/info and clans/accountinfo
+		if _, err := backend.GetPlayerDetails(ctx, []int{1}, false); err != nil {
+			t.Fatal(err)
+		}
+		// ships/stats, the empty response is rejected once received
+		backend.GetPlayerT10Count(ctx, 1)
+		// clans/info
+		if _, err := backend.GetClansDetails(ctx, []int{1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := map[string]int{
+		"/wows/account/info/":      1,
+		"/wows/ships/stats/":       1,
+		"/wows/clans/accountinfo/": 2,
+		"/wows/clans/info/":        2,
+	}
+	for endpoint, requests := range expected {
+		if transport.requests[endpoint] != requests {
+			t.Errorf("%d requests to %s, expected %d (requests: %v)", transport.requests[endpoint], endpoint, requests, transport.requests)
+		}
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	tests := []struct {
+		name       string
+		ttl        time.Duration
+		maxEntries int
+		// Accounts requested in order, then requested again
+		accounts []string
+		// Requests sent for the second round
+		requests int
+	}{
+		{name: "cached", ttl: time.Hour, maxEntries: 10, accounts: []string{"1", "2"}, requests: 0},
+		{name: "expired", ttl: -time.Second, maxEntries: 10, accounts: []string{"1", "2"}, requests: 2},
+		{name: "evicted", ttl: time.Hour, maxEntries: 2, accounts: []string{"1", "2", "3"}, requests: 1},
+		{name: "not cached", ttl: 0, maxEntries: 10, accounts: []string{"1"}, requests: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache, err := NewAPICache(map[string]time.Duration{"/wows/account/info/": test.ttl}, test.maxEntries, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			get := func(account string) []byte {
+				req, _ := http.NewRequest(http.MethodGet, "https://api.worldofwarships.eu/wows//account/info/?account_id="+account, nil)
+				return cache.get(req)
+			}
+			for _, account := range test.accounts {
+				req, _ := http.NewRequest(http.MethodGet, "https://api.worldofwarships.eu/wows//account/info/?account_id="+account+"&application_id=key", nil)
+				cache.set(req, []byte(account))
+			}
+			if len(cache.entries) > test.maxEntries {
+				t.Fatalf("%d entries, more than %d", len(cache.entries), test.maxEntries)
+			}
+			requests := 0
+			for _, account := range test.accounts {
+				body := get(account)
+				if body == nil {
+					requests++
+				} else if string(body) != account {
+					t.Fatalf("account %s answered with %s", account, body)
+				}
+			}
+			if requests != test.requests {
+				t.Fatalf("%d requests not cached, expected %d", requests, test.requests)
+			}
+		})
+	}
+}
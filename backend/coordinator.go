@@ -0,0 +1,188 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/kakwa/wows-recruiting-bot/model"
+	"github.com/kakwa/wows-recruiting-bot/storage"
+	"sync/atomic"
+	"time"
+)
+
+// Locks of the jobs, jobs holding the same lock never run at the same time.
+// Scans holding different locks run together, each clan being claimed by a single scan at a time.
+const (
+	LockFullScan       = "full_scan"
+	LockMonitoredScan  = "monitored_scan"
+	LockClanScan       = "clan_scan"
+	LockAnnouncedCheck = "announced_check"
+)
+
+const (
+	// Locks of a crashed instance are free after this delay, running jobs refresh them before
+	lockTTL = 10 * time.Minute
+	// Delay between two attempts of a queued job to take its lock
+	lockRetryInterval = 30 * time.Second
+	// A job making no progress for this delay is stopped and its lock left to expire
+	progressTimeout = lockTTL / 2
+)
+
+var (
+	ErrJobSkipped = errors.New("Job skipped, its lock is held by another job")
+	ErrJobStalled = errors.New("Job stopped, it made no progress before its lock expired")
+)
+
+// jobPolicy sets the lock of a job and what to do when it's held
+type jobPolicy struct {
+	lock string
+	// Wait for the lock instead of skipping the run
+	queue bool
+}
+
+// The full scan must not be lost until next week, it waits for a running full scan.
+// The monitored scans are frequent, a run overlapping with the previous one is skipped.
+var jobPolicies = map[string]jobPolicy{
+	JobFullScan:       {lock: LockFullScan, queue: true},
+	JobMonitoredScan:  {lock: LockMonitoredScan},
+	JobClanScan:       {lock: LockClanScan, queue: true},
+	JobAnnouncedCheck: {lock: LockAnnouncedCheck},
+}
+
+type progressContextKey struct{}
+
+// jobProgress records the last progress of a running job, its lock is only refreshed while it progresses
+type jobProgress struct {
+	last atomic.Int64
+}
+
+func (progress *jobProgress) since() time.Duration {
+	return time.Since(time.Unix(0, progress.last.Load()))
+}
+
+// reportProgress records that the job running in ctx made progress (a clan, a page or a batch of players done)
+func reportProgress(ctx context.Context) {
+	if progress, ok := ctx.Value(progressContextKey{}).(*jobProgress); ok {
+		progress.last.Store(time.Now().UnixNano())
+	}
+}
+
+// claimOwner returns the owner of the clans claimed by a job of this instance
+func (backend *Backend) claimOwner(job string) string {
+	return backend.InstanceID + "/" + job
+}
+
+func lockHolderString(lock *model.JobLock, instanceID string) string {
+	if lock == nil {
+		return "lock released while checking it"
+	}
+	owner := "instance " + lock.Owner
+	if lock.Owner == instanceID {
+		owner = "this instance"
+	}
+	return fmt.Sprintf("%s running on %s since %s (lock expires at %s)",
+		lock.Job, owner, lock.AcquiredAt.Format(time.RFC3339), lock.ExpiresAt.Format(time.RFC3339))
+}
+
+// RunJob runs a job holding its lock, so it never overlaps with a job writing the same rows,
+// in this bot instance or in another one sharing the DB.
+// If the lock is held, the job waits for it or is skipped with ErrJobSkipped, depending on the job.
+func (backend *Backend) RunJob(ctx context.Context, job string, run func(ctx context.Context) error) (err error) {
+	policy, ok := jobPolicies[job]
+	if !ok {
+		return fmt.Errorf("unknown job '%s'", job)
+	}
+	waiting := false
+	for {
+		acquired, holder, err := storage.AcquireLock(backend.DB, policy.lock, job, backend.InstanceID, lockTTL)
+		if err != nil {
+			backend.Logger.Errorf("failed to take lock '%s' for %s: %s", policy.lock, job, err.Error())
+			return err
+		}
+		if acquired {
+			break
+		}
+		reason := lockHolderString(holder, backend.InstanceID)
+		if !policy.queue {
+			// The scheduler retries every minute, only the first skip for a reason is worth an info
+			if backend.jobSkipped(job, reason) {
+				backend.Logger.Infof("skipping %s: %s", job, reason)
+			} else {
+				backend.Logger.Debugf("skipping %s: %s", job, reason)
+			}
+			return ErrJobSkipped
+		}
+		if !waiting {
+			backend.Logger.Infof("queuing %s: %s", job, reason)
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			backend.Logger.Infof("cancelled queued %s", job)
+			return ctx.Err()
+		case <-time.After(lockRetryInterval):
+		}
+	}
+
+	backend.jobStarted(job)
+	defer func() { backend.jobFinished(job, err) }()
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	progress := &jobProgress{}
+	progress.last.Store(time.Now().UnixNano())
+	done := make(chan struct{})
+	refreshed := make(chan error, 1)
+	go func() {
+		refreshed <- backend.refreshLock(job, policy.lock, progress, done, cancel)
+	}()
+	defer func() {
+		releaseErr := storage.ReleaseLock(backend.DB, policy.lock, backend.InstanceID)
+		if releaseErr != nil {
+			backend.Logger.Errorf("failed to release lock '%s': %s", policy.lock, releaseErr.Error())
+		}
+	}()
+
+	err = run(context.WithValue(withJob(jobCtx, job), progressContextKey{}, progress))
+	close(done)
+	// A job stopped by the refresh returns the reason instead of the cancellation
+	if stopErr := <-refreshed; stopErr != nil {
+		err = stopErr
+	}
+	return err
+}
+
+// refreshLock keeps a lock and the clans claimed by the job held until done is closed.
+// If the job makes no progress, the lock is left to expire. In this case, or if the lock is lost,
+// the job is cancelled as another instance may take over, the reason is returned.
+func (backend *Backend) refreshLock(job string, lock string, progress *jobProgress, done chan struct{}, cancel context.CancelFunc) error {
+	ticker := time.NewTicker(lockTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-ticker.C:
+			if stalled := progress.since(); stalled > progressTimeout {
+				backend.Logger.Errorf("stopping %s: no progress for %s, lock '%s' left to expire", job, stalled.Round(time.Second), lock)
+				cancel()
+				return ErrJobStalled
+			}
+			err := storage.RefreshLock(backend.DB, lock, backend.InstanceID, lockTTL)
+			if errors.Is(err, storage.ErrLockLost) {
+				backend.Logger.Errorf("stopping %s: lock '%s' lost", job, lock)
+				cancel()
+				return fmt.Errorf("%s stopped: %w", job, err)
+			}
+			if err != nil {
+				// The lock is still held until its expiration, the next refresh can succeed
+				backend.Logger.Errorf("failed to refresh lock '%s': %s", lock, err.Error())
+				continue
+			}
+			err = storage.RefreshClanClaims(backend.DB, backend.claimOwner(job), lockTTL)
+			if err != nil {
+				backend.Logger.Errorf("failed to refresh the clans claimed by %s: %s", job, err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package backend
+
+import (
+	"context"
+	"github.com/kakwa/wows-recruiting-bot/metrics"
+	"github.com/kakwa/wows-recruiting-bot/model"
+	"github.com/kakwa/wows-recruiting-bot/storage"
+	"gorm.io/gorm"
+	"sort"
+	"time"
+)
+
+// The scheduler looks for the monitored clans due for a scan at this interval
+const schedulerTick = time.Minute
+
+// DefaultScanIntervals are the scan intervals of the monitored clans by priority
+var DefaultScanIntervals = map[string]time.Duration{
+	model.PriorityHigh:   15 * time.Minute,
+	model.PriorityNormal: 2 * time.Hour,
+	model.PriorityLow:    24 * time.Hour,
+}
+
+// AdaptiveIntervals adapts the scan interval of the monitored clans to their churn:
+// clans losing more players than the average are scanned more often, stable clans less often
+type AdaptiveIntervals struct {
+	Enabled     bool
+	MinInterval time.Duration
+	MaxInterval time.Duration
+	// Period over which the exits of the clans are counted
+	ChurnWindow time.Duration
+}
+
+// DefaultAdaptiveIntervals are the bounds of the adaptive scan intervals.
+// They are disabled by default as they override the priorities set on the clans.
+var DefaultAdaptiveIntervals = AdaptiveIntervals{
+	Enabled:     false,
+	MinInterval: 10 * time.Minute,
+	MaxInterval: 48 * time.Hour,
+	ChurnWindow: 30 * 24 * time.Hour,
+}
+
+// interval scales the interval of the clan priority by the ratio between the average churn and the clan churn,
+// +1 smooths the ratio of clans with few exits
+func (adaptive AdaptiveIntervals) interval(base time.Duration, churn int, averageChurn float64) time.Duration {
+	if !adaptive.Enabled {
+		return base
+	}
+	interval := time.Duration(float64(base) * (averageChurn + 1) / float64(churn+1))
+	if interval < adaptive.MinInterval {
+		return adaptive.MinInterval
+	}
+	if interval > adaptive.MaxInterval {
+		return adaptive.MaxInterval
+	}
+	return interval
+}
+
+// ClanSchedule is the scan schedule of a monitored clan
+type ClanSchedule struct {
+	ClanID   int
+	Priority string
+	// Exits during the churn window
+	Churn    int
+	Interval time.Duration
+	// Zero if never scanned
+	LastScan time.Time
+	NextScan time.Time
+}
+
+// overdue is how late the scan is, relative to the clan interval
+func (schedule ClanSchedule) overdue(now time.Time) float64 {
+	return float64(now.Sub(schedule.NextScan)) / float64(schedule.Interval)
+}
+
+// Schedule returns the scan schedule of the monitored clans, the most urgent first
+func (backend *Backend) Schedule(now time.Time) ([]ClanSchedule, error) {
+	return ClanSchedules(backend.DB, backend.ScanIntervals, backend.Adaptive, now)
+}
+
+// ClanSchedules computes the scan schedule of the monitored clans from the DB, the most urgent first
+func ClanSchedules(db *gorm.DB, scanIntervals map[string]time.Duration, adaptive AdaptiveIntervals, now time.Time) ([]ClanSchedule, error) {
+	priorities, err := storage.MonitoredClanPriorities(db)
+	if err != nil {
+		return nil, err
+	}
+	clanIDs := make([]int, 0, len(priorities))
+	for clanID := range priorities {
+		clanIDs = append(clanIDs, clanID)
+	}
+	lastScans, err := storage.LastScans(db, clanIDs)
+	if err != nil {
+		return nil, err
+	}
+	churns := map[int]int{}
+	averageChurn := 0.0
+	if adaptive.Enabled && len(clanIDs) != 0 {
+		churns, err = storage.ClanChurn(db, clanIDs, now.Add(-adaptive.ChurnWindow))
+		if err != nil {
+			return nil, err
+		}
+		for _, churn := range churns {
+			averageChurn += float64(churn)
+		}
+		averageChurn /= float64(len(clanIDs))
+	}
+	schedules := make([]ClanSchedule, 0, len(clanIDs))
+	for _, clanID := range clanIDs {
+		schedule := ClanSchedule{
+			ClanID:   clanID,
+			Priority: priorities[clanID],
+			Churn:    churns[clanID],
+			Interval: adaptive.interval(scanIntervals[priorities[clanID]], churns[clanID], averageChurn),
+			LastScan: lastScans[clanID],
+		}
+		schedule.NextScan = schedule.LastScan.Add(schedule.Interval)
+		if schedule.LastScan.IsZero() {
+			schedule.NextScan = now
+		}
+		schedules = append(schedules, schedule)
+	}
+	// Higher priorities first, then the most overdue relative to their interval
+	rank := make(map[string]int, len(model.Priorities))
+	for i, priority := range model.Priorities {
+		rank[priority] = i
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		a, b := schedules[i], schedules[j]
+		aDue, bDue := !a.NextScan.After(now), !b.NextScan.After(now)
+		switch {
+		case aDue != bDue:
+			return aDue
+		case !aDue:
+			return a.NextScan.Before(b.NextScan)
+		case rank[a.Priority] != rank[b.Priority]:
+			return rank[a.Priority] < rank[b.Priority]
+		case a.overdue(now) != b.overdue(now):
+			return a.overdue(now) > b.overdue(now)
+		}
+		return a.ClanID < b.ClanID
+	})
+	return schedules, nil
+}
+
+// dueClans returns the most urgent clans due for a scan within the budget, and the number of clans due
+func dueClans(schedules []ClanSchedule, now time.Time, budget int) ([]int, int) {
+	var due []int
+	for _, schedule := range schedules {
+		if schedule.NextScan.After(now) {
+			break
+		}
+		due = append(due, schedule.ClanID)
+	}
+	total := len(due)
+	if budget < 0 {
+		budget = 0
+	}
+	if total > budget {
+		due = due[:budget]
+	}
+	return due, total
+}
+
+// ScanDueClans checks the pending exits and scans the monitored clans due for a scan,
+// at most scan.max_clans_per_minute clans per minute
+func (backend *Backend) ScanDueClans(ctx context.Context) error {
+	return backend.RunJob(ctx, JobMonitoredScan, backend.scanDueClans)
+}
+
+func (backend *Backend) scanDueClans(ctx context.Context) error {
+	now := time.Now()
+	schedules, err := backend.Schedule(now)
+	if err != nil {
+		return err
+	}
+	// The exits at the end of their grace period are checked first
+	exitsErr := backend.CheckPendingExits(ctx)
+	if exitsErr != nil {
+		backend.Logger.Errorf("error when checking pending exits: %s", exitsErr.Error())
+	}
+	due, total := dueClans(schedules, now, backend.MaxClansPerMinute*int(schedulerTick/time.Minute))
+	if total > len(due) {
+		backend.Logger.Infof("%d monitored clans due, scanning the %d most urgent ones", total, len(due))
+	}
+	if len(due) != 0 {
+		backend.Logger.Infof("start scanning %d due monitored clans", len(due))
+		start := time.Now()
+		err = backend.UpdateClans(ctx, due)
+		metrics.ObserveScan("monitored", start)
+		if err != nil {
+			backend.Logger.Errorf("error when scanning clans: %s", err.Error())
+			return err
+		}
+		backend.Logger.Infof("finish scanning %d due monitored clans", len(due))
+	}
+	return exitsErr
+}
+
+// RunScheduler scans the monitored clans according to their priority until ctx is cancelled
+func (backend *Backend) RunScheduler(ctx context.Context) {
+	ticker := time.NewTicker(schedulerTick)
+	defer ticker.Stop()
+	for {
+		backend.ScanDueClans(ctx)
+		// The requests of all the jobs, including the long full scans, are saved every tick
+		backend.FlushAPIUsage()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package backend
+
+import (
+	"github.com/kakwa/wows-recruiting-bot/model"
+	"github.com/kakwa/wows-recruiting-bot/storage"
+	"gorm.io/gorm"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveInterval(t *testing.T) {
+	adaptive := AdaptiveIntervals{Enabled: true, MinInterval: 10 * time.Minute, MaxInterval: 48 * time.Hour}
+	tests := []struct {
+		name         string
+		adaptive     AdaptiveIntervals
+		base         time.Duration
+		churn        int
+		averageChurn float64
+		interval     time.Duration
+	}{
+		{"no churn", adaptive, 2 * time.Hour, 0, 0, 2 * time.Hour},
+		{"high churn", adaptive, 2 * time.Hour, 9, 0, 12 * time.Minute},
+		{"clamped to min", adaptive, 2 * time.Hour, 99, 0, 10 * time.Minute},
+		{"clamped to max", adaptive, 24 * time.Hour, 0, 4, 48 * time.Hour},
+		{"average churn", adaptive, 2 * time.Hour, 4, 4, 2 * time.Hour},
+		{"disabled", AdaptiveIntervals{MinInterval: 10 * time.Minute, MaxInterval: 48 * time.Hour}, 2 * time.Hour, 99, 0, 2 * time.Hour},
+	}
+	for _, test := range tests {
+		if interval := test.adaptive.interval(test.base, test.churn, test.averageChurn); interval != test.interval {
+			t.Errorf("%s: interval = %s, expected %s", test.name, interval, test.interval)
+		}
+	}
+}
+
+// scheduleFixtures monitors 5 clans from a channel, with their priority and last scan
+func scheduleFixtures(t *testing.T, db *gorm.DB, now time.Time) {
+	t.Helper()
+	fixtures := []struct {
+		clanID   int
+		priority string
+		// Not scanned if zero
+		lastScan time.Duration
+	}{
+		{1, model.PriorityHigh, 20 * time.Minute},
+		{2, model.PriorityNormal, 3 * time.Hour},
+		{3, model.PriorityLow, 48 * time.Hour},
+		{4, model.PriorityNormal, 0},
+		{5, model.PriorityHigh, 5 * time.Minute},
+	}
+	var clans []model.Clan
+	for _, fixture := range fixtures {
+		clans = append(clans, model.Clan{ID: fixture.clanID, Tag: "CLAN" + strconv.Itoa(fixture.clanID), Tracked: true})
+	}
+	err := db.Create(&model.Filter{DiscordChannelID: "channel", TrackedClans: clans}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fixture := range fixtures {
+		err = db.Create(&model.ClanPriority{DiscordChannelID: "channel", ClanID: fixture.clanID, Priority: fixture.priority}).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fixture.lastScan != 0 {
+			err = storage.MarkClansScanned(db, []int{fixture.clanID}, now.Add(-fixture.lastScan))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestClanSchedules(t *testing.T) {
+	db := storage.OpenTestDB(t)
+	now := time.Now()
+	scheduleFixtures(t, db, now)
+	schedules, err := ClanSchedules(db, DefaultScanIntervals, AdaptiveIntervals{}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Due clans by priority then by overdue ratio, then the clans not due yet
+	var order []int
+	for _, schedule := range schedules {
+		order = append(order, schedule.ClanID)
+	}
+	if expected := []int{1, 2, 4, 3, 5}; !reflect.DeepEqual(order, expected) {
+		t.Fatalf("schedule order = %v, expected %v", order, expected)
+	}
+
+	tests := []struct {
+		budget int
+		due    []int
+	}{
+		{10, []int{1, 2, 4, 3}},
+		{2, []int{1, 2}},
+		{0, []int{}},
+		{-1, []int{}},
+	}
+	for _, test := range tests {
+		due, total := dueClans(schedules, now, test.budget)
+		if !reflect.DeepEqual(due, test.due) {
+			t.Errorf("budget %d: due clans = %v, expected %v", test.budget, due, test.due)
+		}
+		if total != 4 {
+			t.Errorf("budget %d: %d clans due, expected 4", test.budget, total)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package backend
+
+import (
+	"time"
+)
+
+// Names of the periodic jobs tracked in the status
+const (
+	JobFullScan       = "full_scan"
+	JobMonitoredScan  = "monitored_scan"
+	JobAnnouncedCheck = "announced_check"
+	// Scan of some clans requested by hand
+	JobClanScan = "clan_scan"
+)
+
+// JobStatus is the state of a periodic job
+type JobStatus struct {
+	Running     bool      `json:"running"`
+	LastStart   time.Time `json:"last_start"`
+	LastEnd     time.Time `json:"last_end"`
+	LastSuccess time.Time `json:"last_success"`
+	LastError   string    `json:"last_error,omitempty"`
+	// Last run skipped because another job held the lock
+	LastSkip       time.Time `json:"last_skip"`
+	LastSkipReason string    `json:"last_skip_reason,omitempty"`
+}
+
+func (backend *Backend) jobStarted(name string) {
+	backend.statusLock.Lock()
+	defer backend.statusLock.Unlock()
+	status := backend.jobs[name]
+	status.Running = true
+	status.LastStart = time.Now()
+	backend.jobs[name] = status
+}
+
+func (backend *Backend) jobFinished(name string, err error) {
+	backend.statusLock.Lock()
+	defer backend.statusLock.Unlock()
+	status := backend.jobs[name]
+	status.Running = false
+	status.LastEnd = time.Now()
+	if err != nil {
+		status.LastError = err.Error()
+	} else {
+		status.LastError = ""
+		status.LastSuccess = status.LastEnd
+	}
+	backend.jobs[name] = status
+}
+
+// jobSkipped records a skipped run, it reports if the previous run was skipped for another reason
+func (backend *Backend) jobSkipped(name string, reason string) bool {
+	backend.statusLock.Lock()
+	defer backend.statusLock.Unlock()
+	status := backend.jobs[name]
+	newReason := status.LastSkip.Before(status.LastStart) || status.LastSkipReason != reason
+	status.LastSkip = time.Now()
+	status.LastSkipReason = reason
+	backend.jobs[name] = status
+	return newReason
+}
+
+// JobStatuses returns the state of the jobs which ran at least once
+func (backend *Backend) JobStatuses() map[string]JobStatus {
+	backend.statusLock.Lock()
+	defer backend.statusLock.Unlock()
+	jobs := make(map[string]JobStatus, len(backend.jobs))
+	for name, status := range backend.jobs {
+		jobs[name] = status
+	}
+	return jobs
+}
+
+func (backend *Backend) ShipMappingLoaded() bool {
+	return len(backend.ShipMapping) != 0
+}
@@ -0,0 +1,151 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Modes of the API traffic
+const (
+	// Requests sent to the API
+	TrafficLive = "live"
+	// Requests sent to the API, their responses are saved
+	TrafficRecord = "record"
+	// Requests answered by the saved responses, without network access
+	TrafficReplay = "replay"
+)
+
+var ErrNotRecorded = errors.New("No recorded response for this request")
+
+// recordedResponse is the format of the files of a recording
+type recordedResponse struct {
+	Key        string `json:"key"`
+	StatusCode int    `json:"status_code"`
+	Body       string `json:"body"`
+}
+
+// trafficFiles names the files of a recording, a request sent several times has a file by occurrence
+type trafficFiles struct {
+	dir string
+
+	lock sync.Mutex
+	// Occurrences of each request seen so far
+	seen map[string]int
+}
+
+func (files *trafficFiles) path(key string, occurrence int) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(files.dir, fmt.Sprintf("%s-%d.json", hex.EncodeToString(sum[:]), occurrence))
+}
+
+// next returns the occurrence of a request, counting it
+func (files *trafficFiles) next(key string) int {
+	files.lock.Lock()
+	defer files.lock.Unlock()
+	occurrence := files.seen[key]
+	files.seen[key] = occurrence + 1
+	return occurrence
+}
+
+// TrafficRecorder sends the requests to the API and saves the responses in a directory
+type TrafficRecorder struct {
+	files trafficFiles
+	next  http.RoundTripper
+}
+
+// NewTrafficRecorder creates a transport recording the API traffic in dir, next sends the requests (default transport if nil).
+// A recording is replayed from the start by a single run, so dir must not contain another recording.
+func NewTrafficRecorder(dir string, next http.RoundTripper) (*TrafficRecorder, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+	recorded, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(recorded) != 0 {
+		return nil, fmt.Errorf("'%s' already contains a recording, record each run in a new directory", dir)
+	}
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &TrafficRecorder{files: trafficFiles{dir: dir, seen: make(map[string]int)}, next: next}, nil
+}
+
+func (recorder *TrafficRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := recorder.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	key := cacheKey(req)
+	occurrence := recorder.files.next(key)
+	data, err := json.Marshal(recordedResponse{Key: key, StatusCode: resp.StatusCode, Body: string(body)})
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(recorder.files.path(key, occurrence), data, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record the response: %w", err)
+	}
+	return resp, nil
+}
+
+// TrafficReplayer answers the requests with the responses of a recording, in the order they were recorded.
+// Once the responses of a request are all replayed, the last one is returned again.
+type TrafficReplayer struct {
+	files trafficFiles
+}
+
+// NewTrafficReplayer creates a transport replaying the API traffic recorded in dir
+func NewTrafficReplayer(dir string) (*TrafficReplayer, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("'%s' is not a directory", dir)
+	}
+	return &TrafficReplayer{files: trafficFiles{dir: dir, seen: make(map[string]int)}}, nil
+}
+
+func (replayer *TrafficReplayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := cacheKey(req)
+	occurrence := replayer.files.next(key)
+	data, err := os.ReadFile(replayer.files.path(key, occurrence))
+	for errors.Is(err, os.ErrNotExist) && occurrence > 0 {
+		occurrence--
+		data, err = os.ReadFile(replayer.files.path(key, occurrence))
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotRecorded, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var recorded recordedResponse
+	err = json.Unmarshal(data, &recorded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recorded response for %s: %w", key, err)
+	}
+	resp := cachedResponse(req, []byte(recorded.Body))
+	resp.StatusCode = recorded.StatusCode
+	resp.Status = fmt.Sprintf("%d %s", recorded.StatusCode, http.StatusText(recorded.StatusCode))
+	return resp, nil
+}
@@ -0,0 +1,78 @@
+package backend
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// countingTransport answers each request with the number of requests received so far
+type countingTransport struct {
+	requests int
+}
+
+func (transport *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport.requests++
+	return cachedResponse(req, []byte(strconv.Itoa(transport.requests))), nil
+}
+
+func roundTrip(t *testing.T, transport http.RoundTripper, url string) (string, error) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body), nil
+}
+
+func TestTrafficRecordReplay(t *testing.T) {
+	dir := t.TempDir()
+	const url = "https://api.worldofwarships.eu/wows//clans/info/?clan_id=1"
+	recorder, err := NewTrafficRecorder(dir, &countingTransport{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The application ID is not part of the recording
+	for _, key := range []string{"a", "b"} {
+		if _, err := roundTrip(t, recorder, url+"&application_id="+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The responses are replayed in order, the last one again once all were replayed
+	replayer, err := NewTrafficReplayer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bodies []string
+	for i := 0; i < 3; i++ {
+		body, err := roundTrip(t, replayer, url+"&application_id=c")
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodies = append(bodies, body)
+	}
+	if strings.Join(bodies, ",") != "1,2,2" {
+		t.Fatalf("replayed %v, expected 1,2,2", bodies)
+	}
+	if _, err := roundTrip(t, replayer, url+"2"); !errors.Is(err, ErrNotRecorded) {
+		t.Fatalf("request not recorded: %v, expected ErrNotRecorded", err)
+	}
+
+	// A second run can't be added to the recording
+	if _, err := NewTrafficRecorder(dir, nil); err == nil {
+		t.Fatal("recording twice in the same directory")
+	}
+}
@@ -0,0 +1,122 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/kakwa/wows-recruiting-bot/metrics"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// apiStatus is the envelope common to all the Wargaming API responses
+type apiStatus struct {
+	Status string `json:"status"`
+	Error  struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// instrumentedTransport records the Wargaming API calls in the metrics and the API usage,
+// it spreads them over the application IDs of the pool
+type instrumentedTransport struct {
+	next  http.RoundTripper
+	keys  *keyPool
+	usage *usageRecorder
+	// Responses cache, disabled if nil
+	cache *APICache
+}
+
+func newInstrumentedTransport(next http.RoundTripper, keys *keyPool, usage *usageRecorder) *instrumentedTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &instrumentedTransport{next: next, keys: keys, usage: usage}
+}
+
+// endpointPath returns the endpoint of an API request (ex: /wows/clans/info/), it labels the metrics and selects the cache TTL.
+// The client builds the paths with a double slash (ex: /wows//clans/info/), they are collapsed.
+func endpointPath(req *http.Request) string {
+	path := req.URL.Path
+	for strings.Contains(path, "//") {
+		path = strings.ReplaceAll(path, "//", "/")
+	}
+	return path
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := endpointPath(req)
+	if t.cache != nil {
+		if body := t.cache.get(req); body != nil {
+			metrics.APICacheRequests.WithLabelValues(endpoint, "hit").Inc()
+			return cachedResponse(req, body), nil
+		}
+		metrics.APICacheRequests.WithLabelValues(endpoint, "miss").Inc()
+	}
+	// The client sets its own application ID, it's replaced by the next one of the pool
+	key := t.keys.pick()
+	req = req.Clone(req.Context())
+	query := req.URL.Query()
+	query.Set("application_id", key)
+	req.URL.RawQuery = query.Encode()
+
+	job := jobFromContext(req.Context())
+	application := MaskKey(key)
+	metrics.APIKeyRequests.WithLabelValues(application).Inc()
+	metrics.APIJobRequests.WithLabelValues(job).Inc()
+	t.usage.add(usageDay(time.Now()), job, application, 1)
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	metrics.APIRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.APIRequests.WithLabelValues(endpoint, "transport_error").Inc()
+		return resp, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		metrics.APIRequests.WithLabelValues(endpoint, fmt.Sprintf("http_%d", resp.StatusCode)).Inc()
+		return resp, nil
+	}
+
+	// The API errors are returned with a 200, the body must be decoded to get the result
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		metrics.APIRequests.WithLabelValues(endpoint, "transport_error").Inc()
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	var status apiStatus
+	result := "ok"
+	if err := json.Unmarshal(body, &status); err != nil {
+		result = "invalid_response"
+	} else if status.Status != "ok" {
+		result = strings.ToLower(status.Error.Message)
+		if result == "" {
+			result = "error"
+		}
+	}
+	metrics.APIRequests.WithLabelValues(endpoint, result).Inc()
+	if result == "ok" && t.cache != nil {
+		t.cache.set(req, body)
+	}
+	return resp, nil
+}
+
+// cachedResponse builds the response of a request answered by the cache
+func cachedResponse(req *http.Request, body []byte) *http.Response {
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
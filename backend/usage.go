@@ -0,0 +1,107 @@
+package backend
+
+import (
+	"context"
+	"github.com/kakwa/wows-recruiting-bot/model"
+	"github.com/kakwa/wows-recruiting-bot/storage"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Job of the API requests done outside of the periodic jobs (ship list, player lookups...)
+const JobOther = "other"
+
+type jobContextKey struct{}
+
+// withJob tags the API requests done with the context with the job running them
+func withJob(ctx context.Context, job string) context.Context {
+	return context.WithValue(ctx, jobContextKey{}, job)
+}
+
+func jobFromContext(ctx context.Context) string {
+	if job, ok := ctx.Value(jobContextKey{}).(string); ok {
+		return job
+	}
+	return JobOther
+}
+
+// MaskKey hides most of an application ID so it can be shown in metrics and reports
+func MaskKey(key string) string {
+	if len(key) <= 8 {
+		return "****"
+	}
+	return key[:4] + "..." + key[len(key)-4:]
+}
+
+// keyPool spreads the API requests over several application IDs, each one having its own request limit
+type keyPool struct {
+	keys []string
+	next uint64
+}
+
+func newKeyPool(keys []string) *keyPool {
+	return &keyPool{keys: keys}
+}
+
+// pick returns the application IDs in turn
+func (pool *keyPool) pick() string {
+	n := atomic.AddUint64(&pool.next, 1) - 1
+	return pool.keys[n%uint64(len(pool.keys))]
+}
+
+type usageKey struct {
+	day         string
+	job         string
+	application string
+}
+
+// usageRecorder counts the API requests until they are flushed to the DB
+type usageRecorder struct {
+	lock   sync.Mutex
+	counts map[usageKey]int64
+}
+
+func newUsageRecorder() *usageRecorder {
+	return &usageRecorder{counts: make(map[usageKey]int64)}
+}
+
+// usageDay returns the day of the API usage, days are in UTC
+func usageDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+func (recorder *usageRecorder) add(day string, job string, application string, requests int64) {
+	key := usageKey{day: day, job: job, application: application}
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	recorder.counts[key] += requests
+}
+
+// take returns the counts recorded since the last call
+func (recorder *usageRecorder) take() []model.APIUsage {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	usages := make([]model.APIUsage, 0, len(recorder.counts))
+	for key, requests := range recorder.counts {
+		usages = append(usages, model.APIUsage{Day: key.day, Job: key.job, Application: key.application, Requests: requests})
+	}
+	recorder.counts = make(map[usageKey]int64)
+	return usages
+}
+
+// FlushAPIUsage saves the API requests counted since the last flush in the daily usage
+func (backend *Backend) FlushAPIUsage() {
+	usages := backend.usage.take()
+	if len(usages) == 0 {
+		return
+	}
+	err := storage.AddAPIUsage(backend.DB, usages)
+	if err != nil {
+		backend.Logger.Errorf("failed to save the API usage: %s", err.Error())
+		// Kept for the next flush
+		for _, usage := range usages {
+			backend.usage.add(usage.Day, usage.Job, usage.Application, usage.Requests)
+		}
+	}
+}
@@ -3,16 +3,23 @@ package backend
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/IceflowRE/go-wargaming/v3/wargaming"
 	"github.com/IceflowRE/go-wargaming/v3/wargaming/wows"
-	"github.com/kakwa/wows-recruiting-bot/common"
+	"github.com/kakwa/wows-recruiting-bot/metrics"
 	"github.com/kakwa/wows-recruiting-bot/model"
+	"github.com/kakwa/wows-recruiting-bot/storage"
 	"github.com/pemistahl/lingua-go"
 	"go.uber.org/zap"
 	"golang.org/x/exp/constraints"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
+	"hash/fnv"
 	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -22,9 +29,13 @@ var (
 	AsiaRealm = wargaming.RealmAsia
 )
 
+// Announced players are followed for this period after their announcement
+const FollowUpPeriod = 30 * 24 * time.Hour
+
 var (
 	ErrShipReturnInvalid = errors.New("Invalid return size for ship listing")
 	ErrUnknownRealm      = errors.New("Unknown Wows realm/server")
+	ErrNoAPIKey          = errors.New("No Wargaming application ID")
 )
 
 func WowsRealm(realmStr string) (wargaming.Realm, error) {
@@ -40,14 +51,82 @@ func WowsRealm(realmStr string) (wargaming.Realm, error) {
 	}
 }
 
+// DefaultLanguages are the languages used to detect the clan languages
+var DefaultLanguages = []lingua.Language{
+	lingua.English,
+	lingua.German,
+	lingua.French,
+	lingua.Polish,
+	lingua.Italian,
+	lingua.Spanish,
+	lingua.Dutch,
+	lingua.Welsh,
+	lingua.Danish,
+	lingua.Bokmal,
+	lingua.Nynorsk,
+	lingua.Swedish,
+	lingua.Czech,
+	lingua.Turkish,
+	lingua.Finnish,
+	lingua.Hungarian,
+	lingua.Catalan,
+	lingua.Slovak,
+	lingua.Romanian,
+	lingua.Portuguese,
+	lingua.Russian,
+	lingua.Estonian,
+	lingua.Bosnian,
+	lingua.Lithuanian,
+	lingua.Albanian,
+	lingua.Macedonian,
+	lingua.Icelandic,
+	lingua.Ukrainian,
+	lingua.Croatian,
+	lingua.Slovene,
+	lingua.Irish,
+	lingua.Chinese,
+	lingua.Japanese,
+	lingua.Azerbaijani,
+	lingua.Latvian,
+	lingua.Serbian,
+	lingua.Bulgarian,
+	lingua.Belarusian,
+	lingua.Macedonian,
+	lingua.Greek,
+	lingua.Hebrew,
+	lingua.Vietnamese,
+	lingua.Kazakh,
+}
+
 type Backend struct {
-	client         *wargaming.Client
-	ShipMapping    map[int]int
-	Realm          wargaming.Realm
-	Detector       lingua.LanguageDetector
-	Logger         *zap.SugaredLogger
-	DB             *gorm.DB
-	PlayerExitChan chan common.PlayerExitNotification
+	client      *wargaming.Client
+	ShipMapping map[int]int
+	Realm       wargaming.Realm
+	Detector    lingua.LanguageDetector
+	Logger      *zap.SugaredLogger
+	DB          *gorm.DB
+	// Exits are only announced if the player is still out of the clan after this period
+	ExitGracePeriod time.Duration
+	// Tier of the ships counted in Player.NumberT10
+	TopTier int
+	// Scan interval of the monitored clans by priority
+	ScanIntervals map[string]time.Duration
+	Adaptive      AdaptiveIntervals
+	// Budget of the scheduler in clans, the monitored clans due beyond it wait for the next minute.
+	// It only limits the monitored scan, the other jobs and the pending exits checks are not counted.
+	MaxClansPerMinute int
+	// Number of daily shards of the rolling full scan, all the clans are refreshed once every FullScanShards days
+	FullScanShards int
+
+	// Identifies the bot instance holding the job locks
+	InstanceID string
+
+	statusLock sync.Mutex
+	jobs       map[string]JobStatus
+
+	// API requests not yet saved in the daily usage
+	usage     *usageRecorder
+	transport *instrumentedTransport
 }
 
 func min[T constraints.Ordered](a, b T) T {
@@ -68,81 +147,81 @@ func difference(a, b []*model.Player) []*model.Player {
 			diff = append(diff, x)
 		}
 	}
+	// The exits are handled in the same order whatever the order of the DB rows
+	sort.Slice(diff, func(i, j int) bool { return diff[i].ID < diff[j].ID })
 	return diff
 }
 
-func NewBackend(key string, realm string, logger *zap.SugaredLogger, db *gorm.DB, playerExitChan chan common.PlayerExitNotification) *Backend {
-	languages := []lingua.Language{
-		lingua.English,
-		lingua.German,
-		lingua.French,
-		lingua.Polish,
-		lingua.Italian,
-		lingua.Spanish,
-		lingua.Dutch,
-		lingua.Welsh,
-		lingua.Danish,
-		lingua.Bokmal,
-		lingua.Nynorsk,
-		lingua.Swedish,
-		lingua.Czech,
-		lingua.Turkish,
-		lingua.Finnish,
-		lingua.Hungarian,
-		lingua.Catalan,
-		lingua.Slovak,
-		lingua.Romanian,
-		lingua.Portuguese,
-		lingua.Russian,
-		lingua.Estonian,
-		lingua.Bosnian,
-		lingua.Lithuanian,
-		lingua.Albanian,
-		lingua.Macedonian,
-		lingua.Icelandic,
-		lingua.Ukrainian,
-		lingua.Croatian,
-		lingua.Slovene,
-		lingua.Irish,
-		lingua.Chinese,
-		lingua.Japanese,
-		lingua.Azerbaijani,
-		lingua.Latvian,
-		lingua.Serbian,
-		lingua.Bulgarian,
-		lingua.Belarusian,
-		lingua.Macedonian,
-		lingua.Greek,
-		lingua.Hebrew,
-		lingua.Vietnamese,
-		lingua.Kazakh,
+func NewBackend(keys []string, realm string, httpTimeout time.Duration, languages []lingua.Language, logger *zap.SugaredLogger, db *gorm.DB) (*Backend, error) {
+	if len(languages) == 0 {
+		languages = DefaultLanguages
 	}
-
 	detector := lingua.NewLanguageDetectorBuilder().
 		FromLanguages(languages...).
 		Build()
 	wReam, err := WowsRealm(realm)
 	if err != nil {
-		return nil
+		return nil, err
 	}
+	if len(keys) == 0 {
+		return nil, ErrNoAPIKey
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	usage := newUsageRecorder()
+	transport := newInstrumentedTransport(nil, newKeyPool(keys), usage)
 	return &Backend{
-		client:         wargaming.NewClient(key, &wargaming.ClientOptions{HTTPClient: &http.Client{Timeout: 10 * time.Second}}),
-		ShipMapping:    make(map[int]int),
-		Detector:       detector,
-		Realm:          wReam,
-		Logger:         logger,
-		DB:             db,
-		PlayerExitChan: playerExitChan,
+		client:            wargaming.NewClient(keys[0], &wargaming.ClientOptions{HTTPClient: &http.Client{Timeout: httpTimeout, Transport: transport}}),
+		ShipMapping:       make(map[int]int),
+		Detector:          detector,
+		Realm:             wReam,
+		Logger:            logger,
+		DB:                db,
+		TopTier:           10,
+		ScanIntervals:     DefaultScanIntervals,
+		Adaptive:          DefaultAdaptiveIntervals,
+		MaxClansPerMinute: 100,
+		FullScanShards:    7,
+		InstanceID:        fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+		jobs:              make(map[string]JobStatus),
+		usage:             usage,
+		transport:         transport,
+	}, nil
+}
+
+// SetAPICache enables the cache of the API responses, it must be set before the first request
+func (backend *Backend) SetAPICache(cache *APICache) {
+	backend.transport.cache = cache
+}
+
+// SetAPITransport replaces the transport sending the API requests (ex: to record or replay the traffic),
+// it must be set before the first request
+func (backend *Backend) SetAPITransport(transport http.RoundTripper) {
+	backend.transport.next = transport
+}
+
+// PurgeAPICache removes the expired API responses from the cache
+func (backend *Backend) PurgeAPICache() {
+	cache := backend.transport.cache
+	if cache == nil {
+		return
+	}
+	count, err := cache.Purge()
+	if err != nil {
+		backend.Logger.Errorf("failed to purge the API cache: %s", err.Error())
 	}
+	backend.Logger.Debugf("purged %d expired API responses from the cache", count)
 }
 
-func (backend *Backend) FillShipMapping() error {
+func (backend *Backend) FillShipMapping(ctx context.Context) error {
 	backend.Logger.Debugf("Start filling ship mapping")
 	client := backend.client
 	respSize := 9999
 	pageNo := 1
 	for respSize != 0 {
-		res, _, err := client.Wows.EncyclopediaShips(context.Background(), wargaming.RealmEu, &wows.EncyclopediaShipsOptions{
+		res, _, err := client.Wows.EncyclopediaShips(ctx, wargaming.RealmEu, &wows.EncyclopediaShipsOptions{
 			Fields: []string{"ship_id", "tier"},
 			PageNo: &pageNo,
 		})
@@ -166,13 +245,13 @@ func (backend *Backend) FillShipMapping() error {
 
 }
 
-func (backend *Backend) GetPlayerT10Count(playerId int) (int, error) {
+func (backend *Backend) GetPlayerT10Count(ctx context.Context, playerId int) (int, error) {
 	backend.Logger.Debugf("Start getting T10 ship count for player %d", playerId)
 	realm := backend.Realm
 	client := backend.client
 	ret := 0
 	inGarage := "1"
-	res, _, err := client.Wows.ShipsStats(context.Background(), realm, playerId, &wows.ShipsStatsOptions{
+	res, _, err := client.Wows.ShipsStats(ctx, realm, playerId, &wows.ShipsStatsOptions{
 		Fields:   []string{"ship_id"},
 		InGarage: &inGarage,
 	})
@@ -194,7 +273,7 @@ func (backend *Backend) GetPlayerT10Count(playerId int) (int, error) {
 		if !ok {
 			continue
 		}
-		if shipTier == 10 {
+		if shipTier == backend.TopTier {
 			ret++
 		}
 	}
@@ -202,35 +281,50 @@ func (backend *Backend) GetPlayerT10Count(playerId int) (int, error) {
 	return ret, nil
 }
 
-func (backend *Backend) GetPlayerDetails(playerIds []int, withT10 bool) ([]*model.Player, error) {
+func (backend *Backend) GetPlayerDetails(ctx context.Context, playerIds []int, withT10 bool) ([]*model.Player, error) {
 	backend.Logger.Debugf("Start getting player details for players %v", playerIds)
 	realm := backend.Realm
 	client := backend.client
 	var ret []*model.Player
-	players, err := client.Wows.AccountInfo(context.Background(), realm, playerIds, &wows.AccountInfoOptions{
+	players, err := client.Wows.AccountInfo(ctx, realm, playerIds, &wows.AccountInfoOptions{
 		Fields: []string{"account_id", "created_at", "hidden_profile", "last_battle_time", "logout_at", "nickname", "statistics.pvp.wins", "statistics.pvp.battles", "statistics.battles"},
 	})
 	if err != nil {
 		return nil, err
 	}
-	clanPlayers, err := client.Wows.ClansAccountinfo(context.Background(), realm, playerIds, &wows.ClansAccountinfoOptions{})
+	clanPlayers, err := client.Wows.ClansAccountinfo(ctx, realm, playerIds, &wows.ClansAccountinfoOptions{
+		Extra: []string{"clan"},
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	for _, playerData := range players {
+	// In the order of the request, the API returns a map
+	for _, playerID := range playerIds {
+		playerData := players[playerID]
 		if playerData == nil {
 			continue
 		}
 
 		T10Count := 0
-		JoinDate := time.Now()
-		if clanPlayer, ok := clanPlayers[*playerData.AccountId]; ok {
-			JoinDate = clanPlayer.JoinedAt.Time
+		// Unknown if the player is clanless, not the current date which would change from one run to another
+		var JoinDate time.Time
+		ClanID := 0
+		ClanTag := ""
+		if clanPlayer, ok := clanPlayers[*playerData.AccountId]; ok && clanPlayer != nil {
+			if clanPlayer.JoinedAt != nil {
+				JoinDate = clanPlayer.JoinedAt.Time
+			}
+			if clanPlayer.ClanId != nil {
+				ClanID = *clanPlayer.ClanId
+			}
+			if clanPlayer.Clan != nil && clanPlayer.Clan.Tag != nil {
+				ClanTag = *clanPlayer.Clan.Tag
+			}
 		}
 
 		if withT10 {
-			T10Count, err = backend.GetPlayerT10Count(*playerData.AccountId)
+			T10Count, err = backend.GetPlayerT10Count(ctx, *playerData.AccountId)
 			if err != nil {
 				T10Count = 0
 			}
@@ -256,6 +350,8 @@ func (backend *Backend) GetPlayerDetails(playerIds []int, withT10 bool) ([]*mode
 			NumberT10:           T10Count,
 			HiddenProfile:       *playerData.HiddenProfile,
 			Tracked:             false,
+			ClanID:              ClanID,
+			ClanTag:             ClanTag,
 			ClanJoinDate:        JoinDate,
 		}
 		ret = append(ret, player)
@@ -264,12 +360,12 @@ func (backend *Backend) GetPlayerDetails(playerIds []int, withT10 bool) ([]*mode
 	return ret, nil
 }
 
-func (backend *Backend) ListClansIds(page int) ([]int, error) {
+func (backend *Backend) ListClansIds(ctx context.Context, page int) ([]int, error) {
 	backend.Logger.Debugf("Start listing clans page[%d]", page)
 	client := backend.client
 	var ret []int
 	limit := 100
-	res, err := client.Wows.ClansList(context.Background(), EURealm, &wows.ClansListOptions{
+	res, err := client.Wows.ClansList(ctx, EURealm, &wows.ClansListOptions{
 		Limit:  &limit,
 		PageNo: &page,
 		Fields: []string{"clan_id"},
@@ -284,9 +380,9 @@ func (backend *Backend) ListClansIds(page int) ([]int, error) {
 	return ret, nil
 }
 
-func (backend *Backend) GetClansDetails(clanIDs []int) (ret []*model.Clan, err error) {
+func (backend *Backend) GetClansDetails(ctx context.Context, clanIDs []int) (ret []*model.Clan, err error) {
 	client := backend.client
-	clanInfo, err := client.Wows.ClansInfo(context.Background(), EURealm, clanIDs, &wows.ClansInfoOptions{
+	clanInfo, err := client.Wows.ClansInfo(ctx, EURealm, clanIDs, &wows.ClansInfoOptions{
 		Extra:  []string{"members"},
 		Fields: []string{"description", "name", "tag", "clan_id", "created_at", "is_clan_disbanded", "updated_at", "members_ids", "leader_id"},
 	})
@@ -294,7 +390,9 @@ func (backend *Backend) GetClansDetails(clanIDs []int) (ret []*model.Clan, err e
 		return nil, err
 	}
 
-	for _, clan := range clanInfo {
+	// In the order of the request, the API returns a map
+	for _, clanID := range clanIDs {
+		clan := clanInfo[clanID]
 		// Clan doesn't actually exist
 		if clan == nil {
 			continue
@@ -345,74 +443,251 @@ func (backend *Backend) GetClansDetails(clanIDs []int) (ret []*model.Clan, err e
 	return ret, nil
 }
 
-func (backend *Backend) UpdatePlayerListT10(playerList []*model.Player) ([]*model.Player, error) {
+func (backend *Backend) UpdatePlayerListT10(ctx context.Context, playerList []*model.Player) ([]*model.Player, error) {
 	var ids []int
 	for _, player := range playerList {
 		ids = append(ids, player.ID)
 	}
-	return backend.GetPlayerDetails(ids, true)
+	return backend.GetPlayerDetails(ctx, ids, true)
 }
 
-func (backend *Backend) UpdateClans(clanIDs []int) error {
-	for {
-		clanDetails, err := backend.GetClansDetails(clanIDs[0:(min(100, len(clanIDs)))])
+// QueuePlayerExit writes a player exit in the notification outbox, it will be sent by the bot
+func (backend *Backend) QueuePlayerExit(player *model.Player, clan *model.Clan) error {
+	notification := &model.Notification{
+		PlayerID:       player.ID,
+		ClanID:         clan.ID,
+		Nick:           player.Nick,
+		WinRate:        player.WinRate,
+		Battles:        player.Battles,
+		NumberT10:      player.NumberT10,
+		LastBattleDate: player.LastBattleDate,
+		HiddenProfile:  player.HiddenProfile,
+		NewClanID:      player.ClanID,
+		NewClanTag:     player.ClanTag,
+		Status:         model.NotificationPending,
+		NextAttempt:    time.Now(),
+	}
+	return backend.DB.Omit(clause.Associations).Create(notification).Error
+}
+
+// recordPreviousClan adds the clan left by a player to the player's clan history
+func (backend *Backend) recordPreviousClan(playerID int, clanID int, joinDate time.Time, leaveDate time.Time) {
+	err := backend.DB.Create(&model.PreviousClan{
+		JoinDate:  joinDate,
+		LeaveDate: leaveDate,
+		ClanID:    clanID,
+		PlayerID:  playerID,
+	}).Error
+	if err != nil {
+		backend.Logger.Errorf("Failed to record the previous clan of player %d: %s", playerID, err.Error())
+	}
+}
+
+// HandlePlayerExit queues the exit notification, or holds it as pending if a grace period is configured.
+// The exits from clans not monitored are queued directly, they are only detected by the full scans long after the exit.
+// The clan is added to the player's history once the exit is confirmed.
+func (backend *Backend) HandlePlayerExit(player *model.Player, clan *model.Clan) error {
+	if backend.ExitGracePeriod <= 0 || !clan.Tracked {
+		backend.recordPreviousClan(player.ID, clan.ID, player.ClanJoinDate, time.Now())
+		return backend.QueuePlayerExit(player, clan)
+	}
+	backend.Logger.Infof("holding exit of player '%s' from clan [%s] for %s", player.Nick, clan.Tag, backend.ExitGracePeriod)
+	pendingExit := &model.PendingExit{
+		PlayerID:       player.ID,
+		ClanID:         clan.ID,
+		DetectedAt:     time.Now(),
+		ClanJoinDate:   player.ClanJoinDate,
+		Nick:           player.Nick,
+		WinRate:        player.WinRate,
+		Battles:        player.Battles,
+		NumberT10:      player.NumberT10,
+		LastBattleDate: player.LastBattleDate,
+		HiddenProfile:  player.HiddenProfile,
+		NewClanID:      player.ClanID,
+		NewClanTag:     player.ClanTag,
+	}
+	// If the exit is already pending, keep the first detection date
+	return backend.DB.Omit(clause.Associations).Clauses(clause.OnConflict{DoNothing: true}).Create(pendingExit).Error
+}
+
+// CheckPendingExits re-checks the current clan of the players whose exit grace period is over, the oldest exits first.
+// Exits are discarded if the player is back in the clan, and announced and added to the player's history otherwise.
+func (backend *Backend) CheckPendingExits(ctx context.Context) error {
+	var pendingExits []model.PendingExit
+	err := backend.DB.Preload("Clan").Where("detected_at <= ?", time.Now().Add(-backend.ExitGracePeriod)).Order("detected_at, id").Find(&pendingExits).Error
+	if err != nil {
+		return err
+	}
+	if len(pendingExits) == 0 {
+		return nil
+	}
+	backend.Logger.Debugf("Start checking %d pending exits", len(pendingExits))
+
+	var ids []int
+	for _, pendingExit := range pendingExits {
+		ids = append(ids, pendingExit.PlayerID)
+	}
+	currentClans := make(map[int]int, len(ids))
+	currentClanTags := make(map[int]string, len(ids))
+	for len(ids) != 0 {
+		chunk := ids[0:min(100, len(ids))]
+		ids = ids[len(chunk):]
+		clanPlayers, err := backend.client.Wows.ClansAccountinfo(ctx, backend.Realm, chunk, &wows.ClansAccountinfoOptions{
+			Extra:  []string{"clan"},
+			Fields: []string{"account_id", "clan_id", "clan.tag"},
+		})
 		if err != nil {
 			return err
 		}
+		reportProgress(ctx)
+		for playerID, clanPlayer := range clanPlayers {
+			if clanPlayer != nil && clanPlayer.ClanId != nil {
+				currentClans[playerID] = *clanPlayer.ClanId
+			}
+			if clanPlayer != nil && clanPlayer.Clan != nil && clanPlayer.Clan.Tag != nil {
+				currentClanTags[playerID] = *clanPlayer.Clan.Tag
+			}
+		}
+	}
 
-		for _, clan := range clanDetails {
-			var clanPrev model.Clan
-			clanPrev.ID = clan.ID
-			err = backend.DB.Preload("Players").First(&clanPrev).Error
-			if err == nil {
-				// If the clan was previously tracked, we need to keep it tracked
-				if clanPrev.Tracked {
-					clan.Tracked = true
+	for _, pendingExit := range pendingExits {
+		clan := model.Clan{ID: pendingExit.ClanID}
+		if pendingExit.Clan != nil {
+			clan = *pendingExit.Clan
+		}
+		if currentClans[pendingExit.PlayerID] == pendingExit.ClanID {
+			backend.Logger.Infof("player '%s' is back in clan [%s], discarding exit", pendingExit.Nick, clan.Tag)
+			backend.DB.Unscoped().Delete(&pendingExit)
+			continue
+		}
+		backend.Logger.Infof("player '%s' is still out of clan [%s] after %s, announcing exit", pendingExit.Nick, clan.Tag, backend.ExitGracePeriod)
+		backend.recordPreviousClan(pendingExit.PlayerID, pendingExit.ClanID, pendingExit.ClanJoinDate, pendingExit.DetectedAt)
+		player := &model.Player{
+			ID:             pendingExit.PlayerID,
+			Nick:           pendingExit.Nick,
+			WinRate:        pendingExit.WinRate,
+			Battles:        pendingExit.Battles,
+			NumberT10:      pendingExit.NumberT10,
+			LastBattleDate: pendingExit.LastBattleDate,
+			HiddenProfile:  pendingExit.HiddenProfile,
+			ClanID:         currentClans[pendingExit.PlayerID],
+			ClanTag:        currentClanTags[pendingExit.PlayerID],
+		}
+		err = backend.QueuePlayerExit(player, &clan)
+		if err != nil {
+			backend.Logger.Errorf("Failed to queue exit notification for player '%s': %s", pendingExit.Nick, err.Error())
+			continue
+		}
+		backend.DB.Unscoped().Delete(&pendingExit)
+	}
+	backend.Logger.Debugf("Finish checking pending exits")
+	return nil
+}
 
-				}
-				prevPlayersList := make([]int, len(clanPrev.Players))
-				backend.Logger.Debugf("Clan [%s] already present, computing player diff", clan.Tag)
-				for i, player := range clanPrev.Players {
-					prevPlayersList[i] = player.ID
-				}
-				diff := difference(clanPrev.Players, clan.Players)
-				if len(diff) != 0 {
-					diff, err := backend.UpdatePlayerListT10(diff)
-					if err != nil {
-						backend.Logger.Infof("Failed to update players: %s", err.Error())
-						continue
-					}
+// CheckAnnouncedPlayers re-checks the players announced recently and queues follow-up updates
+// when they join a new clan, join the home clan of the channel or become inactive
+func (backend *Backend) CheckAnnouncedPlayers(ctx context.Context) error {
+	return backend.RunJob(ctx, JobAnnouncedCheck, backend.checkAnnouncedPlayers)
+}
 
-					for _, player := range diff {
-						backend.Logger.Infof("player '%s' left clan [%s] (language: %s)", player.Nick, clan.Tag, clan.Language)
-						prevClanEntry := &model.PreviousClan{
-							JoinDate:  player.ClanJoinDate,
-							LeaveDate: time.Now(),
-							ClanID:    clanPrev.ID,
-							PlayerID:  player.ID,
-						}
-						backend.PlayerExitChan <- common.PlayerExitNotification{Player: *player, Clan: clanPrev}
-						backend.DB.Create(prevClanEntry)
-						backend.DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(player)
-					}
-				}
-				backend.DB.Model(&clanPrev).Association("Players").Delete(diff)
-			}
+func (backend *Backend) checkAnnouncedPlayers(ctx context.Context) (err error) {
+	backend.Logger.Infof("start checking announced players")
+	var announcements []model.Announcement
+	err = backend.DB.Where("announced_at > ? AND message_id != ''", time.Now().Add(-FollowUpPeriod)).Find(&announcements).Error
+	if err != nil {
+		return err
+	}
+	if len(announcements) == 0 {
+		return nil
+	}
 
-			// Upsert the clan informations
-			backend.DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(clan)
-			backend.Logger.Debugf("Start getting player details for clan [%s]", clan.Tag)
+	var filters []model.Filter
+	backend.DB.Find(&filters)
+	filterMap := make(map[string]model.Filter, len(filters))
+	for _, filter := range filters {
+		filterMap[filter.DiscordChannelID] = filter
+	}
 
-			// Upsert the players information
-			players, err := backend.GetPlayerDetails(clan.PlayerIDs, false)
-			if err != nil {
-				backend.Logger.Infof("Failed to get Players: %s", err.Error())
+	var ids []int
+	seen := make(map[int]bool)
+	for _, announcement := range announcements {
+		if !seen[announcement.PlayerID] {
+			seen[announcement.PlayerID] = true
+			ids = append(ids, announcement.PlayerID)
+		}
+	}
+	players := make(map[int]*model.Player, len(ids))
+	for len(ids) != 0 {
+		chunk := ids[0:min(100, len(ids))]
+		ids = ids[len(chunk):]
+		details, err := backend.GetPlayerDetails(ctx, chunk, false)
+		if err != nil {
+			return err
+		}
+		reportProgress(ctx)
+		for _, player := range details {
+			players[player.ID] = player
+		}
+	}
+
+	for _, announcement := range announcements {
+		player, ok := players[announcement.PlayerID]
+		if !ok {
+			continue
+		}
+		filter := filterMap[announcement.DiscordChannelID]
+		var events []string
+		if player.ClanID != announcement.ClanID {
+			switch {
+			case player.ClanID == 0:
+				events = append(events, model.FollowUpClanless)
+			case player.ClanID == filter.HomeClanID:
+				events = append(events, model.FollowUpJoinedHomeClan)
+			default:
+				events = append(events, model.FollowUpJoinedClan)
 			}
-			for _, player := range players {
-				player.ClanID = clan.ID
-				backend.DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(player)
+			announcement.ClanID = player.ClanID
+		}
+		inactive := filter.DaysSinceLastBattle > 0 && player.LastBattleDate.Before(time.Now().Add(time.Duration(-24*filter.DaysSinceLastBattle)*time.Hour))
+		if inactive && !announcement.Inactive {
+			events = append(events, model.FollowUpInactive)
+		}
+		announcement.Inactive = inactive
+
+		for _, event := range events {
+			backend.Logger.Infof("announced player '%s' follow-up on channel '%s': %s", player.Nick, announcement.DiscordChannelID, event)
+			followUp := &model.FollowUp{
+				DiscordChannelID: announcement.DiscordChannelID,
+				MessageID:        announcement.MessageID,
+				PlayerID:         player.ID,
+				Nick:             player.Nick,
+				Event:            event,
+				ClanID:           player.ClanID,
+				ClanTag:          player.ClanTag,
+				LastBattleDate:   player.LastBattleDate,
+				Status:           model.NotificationPending,
+				NextAttempt:      time.Now(),
+			}
+			err = backend.DB.Create(followUp).Error
+			if err != nil {
+				backend.Logger.Errorf("Failed to queue follow-up for player '%s': %s", player.Nick, err.Error())
 			}
-			backend.Logger.Debugf("Finish getting player details for clan [%s]", clan.Tag)
+		}
+		backend.DB.Save(&announcement)
+	}
+	backend.Logger.Infof("finish checking %d announced players", len(players))
+	return nil
+}
+
+// UpdateClans scans the clans by batches of 100, on cancellation it stops after the clan being written
+func (backend *Backend) UpdateClans(ctx context.Context, clanIDs []int) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := backend.updateClanBatch(ctx, clanIDs[0:(min(100, len(clanIDs)))])
+		if err != nil {
+			return err
 		}
 		if len(clanIDs) < 100 {
 			break
@@ -422,34 +697,153 @@ func (backend *Backend) UpdateClans(clanIDs []int) error {
 	return nil
 }
 
-func (backend *Backend) ScrapMonitoredClans() (err error) {
+// updateClanBatch scans the clans not being scanned by another job, they are claimed during the scan
+func (backend *Backend) updateClanBatch(ctx context.Context, batch []int) error {
+	job := jobFromContext(ctx)
+	owner := backend.claimOwner(job)
+	clanIDs, err := storage.ClaimClans(backend.DB, batch, job, owner, lockTTL)
+	defer func() {
+		err := storage.ReleaseClans(backend.DB, clanIDs, owner)
+		if err != nil {
+			backend.Logger.Errorf("Failed to release the clans claimed by %s: %s", job, err.Error())
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	if skipped := len(batch) - len(clanIDs); skipped != 0 {
+		backend.Logger.Debugf("Skipping %d clans being scanned by another job", skipped)
+	}
+	if len(clanIDs) == 0 {
+		return nil
+	}
+
+	clanDetails, err := backend.GetClansDetails(ctx, clanIDs)
+	if err != nil {
+		return err
+	}
+
+	for _, clan := range clanDetails {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		reportProgress(ctx)
+		metrics.ClansScanned.Inc()
+		var clanPrev model.Clan
+		clanPrev.ID = clan.ID
+		err = backend.DB.Preload("Players").First(&clanPrev).Error
+		if err == nil {
+			// If the clan was previously tracked, we need to keep it tracked
+			if clanPrev.Tracked {
+				clan.Tracked = true
+
+			}
+			prevPlayersList := make([]int, len(clanPrev.Players))
+			backend.Logger.Debugf("Clan [%s] already present, computing player diff", clan.Tag)
+			for i, player := range clanPrev.Players {
+				prevPlayersList[i] = player.ID
+			}
+			diff := difference(clanPrev.Players, clan.Players)
+			if len(diff) != 0 {
+				diff, err := backend.UpdatePlayerListT10(ctx, diff)
+				if err != nil {
+					backend.Logger.Infof("Failed to update players: %s", err.Error())
+					continue
+				}
+
+				for _, player := range diff {
+					metrics.ExitsDetected.Inc()
+					backend.Logger.Infof("player '%s' left clan [%s] (language: %s), now in clan %d", player.Nick, clan.Tag, clan.Language, player.ClanID)
+					err = backend.HandlePlayerExit(player, &clanPrev)
+					if err != nil {
+						backend.Logger.Errorf("Failed to queue exit notification for player '%s': %s", player.Nick, err.Error())
+					}
+					backend.DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(player)
+				}
+			}
+			backend.DB.Model(&clanPrev).Association("Players").Delete(diff)
+		}
+
+		// Upsert the clan informations
+		backend.DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(clan)
+		backend.Logger.Debugf("Start getting player details for clan [%s]", clan.Tag)
+
+		// Upsert the players information
+		players, err := backend.GetPlayerDetails(ctx, clan.PlayerIDs, false)
+		if err != nil {
+			backend.Logger.Infof("Failed to get Players: %s", err.Error())
+		}
+		metrics.PlayersScanned.Add(float64(len(players)))
+		for _, player := range players {
+			player.ClanID = clan.ID
+			backend.DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(player)
+		}
+		backend.Logger.Debugf("Finish getting player details for clan [%s]", clan.Tag)
+	}
+	err = storage.MarkClansScanned(backend.DB, clanIDs, time.Now())
+	if err != nil {
+		backend.Logger.Errorf("Failed to record the scan of clans: %s", err.Error())
+	}
+	return nil
+}
+
+// ScanClans updates some clans, waiting for the running clan scan to finish
+func (backend *Backend) ScanClans(ctx context.Context, clanIDs []int) error {
+	return backend.RunJob(ctx, JobClanScan, func(ctx context.Context) error {
+		return backend.UpdateClans(ctx, clanIDs)
+	})
+}
+
+// ScrapMonitoredClans updates the monitored clans, it's skipped if the previous run is still running
+func (backend *Backend) ScrapMonitoredClans(ctx context.Context) error {
+	return backend.RunJob(ctx, JobMonitoredScan, backend.scrapMonitoredClans)
+}
+
+func (backend *Backend) scrapMonitoredClans(ctx context.Context) (err error) {
 	backend.Logger.Infof("start scrapping monitored clans")
+	defer metrics.ObserveScan("monitored", time.Now())
 	var clans []model.Clan
 	backend.DB.Where("tracked = true").Find(&clans)
 	var ids []int
 	for _, clan := range clans {
 		ids = append(ids, clan.ID)
 	}
-	err = backend.UpdateClans(ids)
+	err = backend.UpdateClans(ctx, ids)
 	if err != nil {
 		backend.Logger.Errorf("error when scanning clans: %s", err.Error())
 		return err
 	}
+	err = backend.CheckPendingExits(ctx)
+	if err != nil {
+		backend.Logger.Errorf("error when checking pending exits: %s", err.Error())
+		return err
+	}
 	backend.Logger.Infof("finish scrapping %d monitored clans", len(ids))
 	return err
 }
 
-func (backend *Backend) ScrapAllClans() (err error) {
+// ScrapAllClans updates all the clans of the realm, it waits for the running full scan to finish
+func (backend *Backend) ScrapAllClans(ctx context.Context) error {
+	return backend.RunJob(ctx, JobFullScan, backend.scrapAllClans)
+}
+
+func (backend *Backend) scrapAllClans(ctx context.Context) (err error) {
 	backend.Logger.Infof("Start scrapping all clans")
+	defer metrics.ObserveScan("all", time.Now())
 	page := 1
 	for {
 		backend.Logger.Infof("Start scrapping clan page [%d]", page)
-		clanIDs, err := backend.ListClansIds(page)
+		clanIDs, err := backend.ListClansIds(ctx, page)
 		if err != nil {
 			return err
 		}
+		reportProgress(ctx)
 
-		err = backend.UpdateClans(clanIDs)
+		err = backend.UpdateClans(ctx, clanIDs)
+		if ctx.Err() != nil {
+			backend.Logger.Infof("Interrupted scrapping all clans at page [%d]", page)
+			return ctx.Err()
+		}
 		if err != nil {
 			backend.Logger.Errorf("error when scanning clans: %s", err.Error())
 		}
@@ -463,3 +857,58 @@ func (backend *Backend) ScrapAllClans() (err error) {
 	backend.Logger.Infof("Finish scrapping all clans")
 	return nil
 }
+
+// ClanShard returns the shard of a clan, from a hash of its ID
+func ClanShard(clanID int, shards int) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(strconv.Itoa(clanID)))
+	return int(hash.Sum32() % uint32(shards))
+}
+
+// RollingShard returns the shard refreshed by the rolling full scan on the day of date
+func RollingShard(date time.Time, shards int) int {
+	return int(date.UTC().Unix()/(24*3600)) % shards
+}
+
+// ScrapRollingShard updates the clans of the shard of the day, it waits for the running full scan to finish
+func (backend *Backend) ScrapRollingShard(ctx context.Context) error {
+	return backend.ScrapClanShard(ctx, RollingShard(time.Now(), backend.FullScanShards))
+}
+
+// ScrapClanShard updates the known clans of a shard, it waits for the running full scan to finish
+func (backend *Backend) ScrapClanShard(ctx context.Context, shard int) error {
+	return backend.RunJob(ctx, JobFullScan, func(ctx context.Context) error {
+		return backend.scrapClanShard(ctx, shard)
+	})
+}
+
+func (backend *Backend) scrapClanShard(ctx context.Context, shard int) error {
+	shards := backend.FullScanShards
+	backend.Logger.Infof("Start scrapping clan shard %d/%d", shard+1, shards)
+	defer metrics.ObserveScan("shard", time.Now())
+	// The shard is taken from the clans in the DB, the clans are updated by batches of 100
+	var knownIDs []int
+	err := backend.DB.Model(&model.Clan{}).Order("id").Pluck("id", &knownIDs).Error
+	if err != nil {
+		return err
+	}
+	var clanIDs []int
+	for _, clanID := range knownIDs {
+		if ClanShard(clanID, shards) == shard {
+			clanIDs = append(clanIDs, clanID)
+		}
+	}
+	for start := 0; start < len(clanIDs); start += 100 {
+		batch := clanIDs[start:min(start+100, len(clanIDs))]
+		err = backend.UpdateClans(ctx, batch)
+		if ctx.Err() != nil {
+			backend.Logger.Infof("Interrupted scrapping clan shard %d/%d after %d clans", shard+1, shards, start)
+			return ctx.Err()
+		}
+		if err != nil {
+			backend.Logger.Errorf("error when scanning clans: %s", err.Error())
+		}
+	}
+	backend.Logger.Infof("Finish scrapping %d clans of shard %d/%d", len(clanIDs), shard+1, shards)
+	return nil
+}
@@ -2,30 +2,50 @@ package bot
 
 import (
 	"bytes"
-	"encoding/csv"
+	"errors"
 	"fmt"
 	"github.com/bwmarrin/discordgo"
 	"github.com/kakwa/wows-recruiting-bot/common"
+	"github.com/kakwa/wows-recruiting-bot/export"
+	"github.com/kakwa/wows-recruiting-bot/metrics"
 	"github.com/kakwa/wows-recruiting-bot/model"
+	"github.com/kakwa/wows-recruiting-bot/storage"
 	"go.uber.org/zap"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
+	"io"
+	"math"
 	"math/rand"
 	"net/http"
 	"os"
-	"strconv"
 	"sync"
 	"time"
 )
 
+const (
+	outboxPollInterval = 30 * time.Second
+	outboxBatchSize    = 50
+	outboxMaxAttempts  = 10
+	outboxMaxBackoff   = time.Hour
+	// An entry being sent is claimed for this duration, it's retried after it if the bot crashed
+	outboxLease = 5 * time.Minute
+	// On shutdown, the outbox is drained until it's empty or this delay is over
+	outboxShutdownTimeout = time.Minute
+)
+
 type WowsBot struct {
 	BotToken        string
-	PlayerExitChan  chan common.PlayerExitNotification
 	OSSignal        chan os.Signal
 	Logger          *zap.SugaredLogger
 	Discord         *discordgo.Session
 	DB              *gorm.DB
 	CommandHandlers map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate)
+	Notifier        Notifier
+
+	// A dry-run bot leaves the outbox untouched, it remembers the last entries written out instead
+	dryRun             bool
+	lastNotificationID uint
+	lastFollowUpID     uint
 }
 
 var (
@@ -69,6 +89,52 @@ var (
 					MaxValue:    100.0,
 					Required:    true,
 				},
+				{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "ignore-joined-clan",
+					Description: "Ignore players who already joined another clan",
+					Required:    false,
+				},
+			},
+		},
+		{
+			Name:        "wows-recruit-set-cooldown",
+			Description: "Set how long an announced player is not announced again in this channel",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "days",
+					Description: "Number of days before announcing the same player again (0 to disable)",
+					MinValue:    &integerOptionMinValue,
+					Required:    true,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionNumber,
+					Name:        "min-winrate-change",
+					Description: "Re-announce before the end of the cooldown if the Win Rate changed by this much (percent, 0 to disable)",
+					MinValue:    &integerOptionMinValue,
+					MaxValue:    100.0,
+					Required:    false,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "min-t10-change",
+					Description: "Re-announce before the end of the cooldown if the player got this many new T10s (0 to disable)",
+					MinValue:    &integerOptionMinValue,
+					Required:    false,
+				},
+			},
+		},
+		{
+			Name:        "wows-recruit-set-home-clan",
+			Description: "Set the clan recruiting from this channel, announced players joining it are flagged",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "clan-tag",
+					Description: "Clan Tag of the recruiting clan",
+					Required:    true,
+				},
 			},
 		},
 		{
@@ -79,6 +145,35 @@ var (
 			Name:        "wows-recruit-list-clans",
 			Description: "Get the list of monitored clans (in a CSV file)",
 		},
+		{
+			Name:        "wows-recruit-export",
+			Description: "Export the data of this channel (exits, rosters or previous clans of the monitored clans) in a file",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "data",
+					Description: "Data to export",
+					Required:    true,
+					Choices: []*discordgo.ApplicationCommandOptionChoice{
+						{Name: "Exits announced in this channel", Value: string(export.DatasetExits)},
+						{Name: "Players of the monitored clans", Value: string(export.DatasetRoster)},
+						{Name: "Players who left the monitored clans", Value: string(export.DatasetPreviousClans)},
+						{Name: "Monitored clans", Value: string(export.DatasetTrackedClans)},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "format",
+					Description: "File format (default: csv)",
+					Required:    false,
+					Choices: []*discordgo.ApplicationCommandOptionChoice{
+						{Name: "CSV", Value: string(export.FormatCSV)},
+						{Name: "JSON Lines", Value: string(export.FormatJSONL)},
+						{Name: "Parquet", Value: string(export.FormatParquet)},
+					},
+				},
+			},
+		},
 		{
 			Name:        "wows-recruit-replace-clans",
 			Description: "Replace all the monitored clans with a list from a csv file",
@@ -115,6 +210,29 @@ var (
 				},
 			},
 		},
+		{
+			Name:        "wows-recruit-set-clan-priority",
+			Description: "Set how often a monitored clan is scanned",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "clan-tag",
+					Description: "Clan Tag of a monitored clan",
+					Required:    true,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "priority",
+					Description: "Scan priority",
+					Required:    true,
+					Choices: []*discordgo.ApplicationCommandOptionChoice{
+						{Name: "High (scanned every few minutes)", Value: model.PriorityHigh},
+						{Name: "Normal", Value: model.PriorityNormal},
+						{Name: "Low (scanned daily)", Value: model.PriorityLow},
+					},
+				},
+			},
+		},
 	}
 )
 
@@ -125,13 +243,25 @@ func (bot *WowsBot) TestOutput(s *discordgo.Session, i *discordgo.InteractionCre
 			Content: "Sending fake player clan exit for testing",
 		},
 	})
+	bot.Notifier.SendPlayerExitMessage(bot.TestNotification(), i.ChannelID)
+}
+
+// TestNotification builds a fake exit of a random player
+func (bot *WowsBot) TestNotification() common.PlayerExitNotification {
 	var player model.Player
 	wr := 0.45 + rand.Float64()*0.25
-	bot.DB.Where("win_rate > ?", wr).Preload("Clan").Order("win_rate").First(&player)
+	bot.DB.Where("win_rate > ?", wr).Order("win_rate").First(&player)
 	clan := model.Clan{
 		Tag: "TEST",
 	}
-	bot.SendPlayerExitMessage(player, clan, i.ChannelID)
+	var newClan *model.Clan
+	if player.ClanID != 0 {
+		newClan = &model.Clan{}
+		if bot.DB.First(newClan, player.ClanID).Error != nil {
+			newClan = nil
+		}
+	}
+	return common.PlayerExitNotification{Player: player, Clan: clan, NewClan: newClan}
 }
 
 func FilterToString(filter model.Filter) string {
@@ -141,6 +271,29 @@ func FilterToString(filter model.Filter) string {
 		filter.MinNumT10,
 		filter.DaysSinceLastBattle,
 	)
+	if filter.IgnoreJoinedClan {
+		msg += " | Ignoring players who already joined another clan"
+	}
+	if filter.CooldownDays > 0 {
+		msg += " | " + CooldownToString(filter)
+	}
+	return msg
+}
+
+func CooldownToString(filter model.Filter) string {
+	if filter.CooldownDays <= 0 {
+		return "No cooldown, players are announced every time they leave a monitored clan"
+	}
+	msg := fmt.Sprintf("Re-announce cooldown: %d days", filter.CooldownDays)
+	if filter.CooldownMinWRChange > 0 {
+		msg += fmt.Sprintf(" (unless Win Rate changed by %.1f%%", filter.CooldownMinWRChange*100)
+		if filter.CooldownMinT10Change > 0 {
+			msg += fmt.Sprintf(" or %d new T10s", filter.CooldownMinT10Change)
+		}
+		msg += ")"
+	} else if filter.CooldownMinT10Change > 0 {
+		msg += fmt.Sprintf(" (unless %d new T10s)", filter.CooldownMinT10Change)
+	}
 	return msg
 }
 
@@ -157,8 +310,14 @@ func (bot *WowsBot) SetFilter(s *discordgo.Session, i *discordgo.InteractionCrea
 	filter.DaysSinceLastBattle = int(optionMap["max-days-last-battle"].IntValue())
 	filter.MinNumBattles = int(optionMap["min-battles"].IntValue())
 	filter.MinPlayerWR = float64(optionMap["min-winrate"].IntValue()) / 100
+	if opt, ok := optionMap["ignore-joined-clan"]; ok {
+		filter.IgnoreJoinedClan = opt.BoolValue()
+	}
 
-	bot.DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(filter)
+	err := storage.SaveFilterCriterias(bot.DB, &filter)
+	if err != nil {
+		bot.Logger.Errorf("Failed to save filter for channel '%s': %s", i.ChannelID, err.Error())
+	}
 
 	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseChannelMessageWithSource,
@@ -168,6 +327,85 @@ func (bot *WowsBot) SetFilter(s *discordgo.Session, i *discordgo.InteractionCrea
 	})
 }
 
+func (bot *WowsBot) SetCooldown(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	options := i.ApplicationCommandData().Options
+	optionMap := make(map[string]*discordgo.ApplicationCommandInteractionDataOption, len(options))
+	for _, opt := range options {
+		optionMap[opt.Name] = opt
+	}
+	var filter model.Filter
+	filter.DiscordChannelID = i.ChannelID
+	err := bot.DB.First(&filter).Error
+	if err != nil {
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: "Filter doesn't seem to be set for this channel, please use '/wows-recruit-set-filter' first",
+			},
+		})
+		return
+	}
+
+	filter.CooldownDays = int(optionMap["days"].IntValue())
+	filter.CooldownMinWRChange = 0
+	if opt, ok := optionMap["min-winrate-change"]; ok {
+		filter.CooldownMinWRChange = opt.FloatValue() / 100
+	}
+	filter.CooldownMinT10Change = 0
+	if opt, ok := optionMap["min-t10-change"]; ok {
+		filter.CooldownMinT10Change = int(opt.IntValue())
+	}
+	bot.DB.Model(&filter).Select("CooldownDays", "CooldownMinWRChange", "CooldownMinT10Change").Updates(&filter)
+
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: CooldownToString(filter),
+		},
+	})
+}
+
+func (bot *WowsBot) SetHomeClan(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	options := i.ApplicationCommandData().Options
+	optionMap := make(map[string]*discordgo.ApplicationCommandInteractionDataOption, len(options))
+	for _, opt := range options {
+		optionMap[opt.Name] = opt
+	}
+	clanTag := optionMap["clan-tag"].StringValue()
+	var filter model.Filter
+	filter.DiscordChannelID = i.ChannelID
+	err := bot.DB.First(&filter).Error
+	if err != nil {
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: "Filter doesn't seem to be set for this channel, please use '/wows-recruit-set-filter' first",
+			},
+		})
+		return
+	}
+
+	var clan model.Clan
+	err = bot.DB.Where("tag = ?", clanTag).First(&clan).Error
+	if err != nil {
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: "Clan [" + clanTag + "] doesn't seem to exist",
+			},
+		})
+		return
+	}
+
+	bot.DB.Model(&filter).Update("home_clan_id", clan.ID)
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: "Home clan set to [" + clanTag + "]",
+		},
+	})
+}
+
 func (bot *WowsBot) GetFilter(s *discordgo.Session, i *discordgo.InteractionCreate) {
 	var filter model.Filter
 	filter.DiscordChannelID = i.ChannelID
@@ -209,9 +447,7 @@ func (bot *WowsBot) AddMonitoredClan(s *discordgo.Session, i *discordgo.Interact
 		return
 	}
 
-	var clan model.Clan
-	clan.Tag = clanTag
-	err = bot.DB.Where("tag = ?", clanTag).First(&clan).Error
+	_, err = storage.TrackClan(bot.DB, &filter, clanTag)
 	if err != nil {
 		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 			Type: discordgo.InteractionResponseChannelMessageWithSource,
@@ -222,9 +458,6 @@ func (bot *WowsBot) AddMonitoredClan(s *discordgo.Session, i *discordgo.Interact
 		return
 	}
 
-	clan.Tracked = true
-	bot.DB.Save(&clan)
-	bot.DB.Model(&filter).Association("TrackedClans").Append(&clan)
 	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseChannelMessageWithSource,
 		Data: &discordgo.InteractionResponseData{
@@ -253,8 +486,7 @@ func (bot *WowsBot) RemoveMonitoredClan(s *discordgo.Session, i *discordgo.Inter
 		})
 		return
 	}
-	var clan model.Clan
-	err = bot.DB.Where("tag = ?", clanTag).First(&clan).Error
+	_, err = storage.UntrackClan(bot.DB, &filter, clanTag)
 	if err != nil {
 		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 			Type: discordgo.InteractionResponseChannelMessageWithSource,
@@ -265,7 +497,6 @@ func (bot *WowsBot) RemoveMonitoredClan(s *discordgo.Session, i *discordgo.Inter
 		return
 	}
 
-	bot.DB.Model(&filter).Association("TrackedClans").Delete(&clan)
 	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseChannelMessageWithSource,
 		Data: &discordgo.InteractionResponseData{
@@ -274,6 +505,38 @@ func (bot *WowsBot) RemoveMonitoredClan(s *discordgo.Session, i *discordgo.Inter
 	})
 }
 
+func (bot *WowsBot) SetClanPriority(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	options := i.ApplicationCommandData().Options
+	optionMap := make(map[string]*discordgo.ApplicationCommandInteractionDataOption, len(options))
+	for _, opt := range options {
+		optionMap[opt.Name] = opt
+	}
+	clanTag := optionMap["clan-tag"].StringValue()
+	priority := optionMap["priority"].StringValue()
+	content := "Clan [" + clanTag + "] scanned with " + priority + " priority"
+	filter, err := storage.GetFilter(bot.DB, i.ChannelID)
+	if err == nil {
+		_, err = storage.SetClanPriority(bot.DB, filter, clanTag, priority)
+	}
+	switch {
+	case errors.Is(err, storage.ErrFilterNotFound):
+		content = "Filter doesn't seem to be set for this channel, please use '/wows-recruit-set-filter' first"
+	case errors.Is(err, storage.ErrClanNotFound):
+		content = "Clan [" + clanTag + "] doesn't seem to exist"
+	case errors.Is(err, storage.ErrClanNotTracked):
+		content = "Clan [" + clanTag + "] isn't monitored by this channel, please use '/wows-recruit-add-clan' first"
+	case err != nil:
+		bot.Logger.Errorf("Failed to set the priority of clan [%s]: %s", clanTag, err.Error())
+		content = "Failed to set the priority of clan [" + clanTag + "]"
+	}
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: content,
+		},
+	})
+}
+
 func (bot *WowsBot) ListMonitoredClans(s *discordgo.Session, i *discordgo.InteractionCreate) {
 	var filter model.Filter
 	filter.DiscordChannelID = i.ChannelID
@@ -288,17 +551,7 @@ func (bot *WowsBot) ListMonitoredClans(s *discordgo.Session, i *discordgo.Intera
 		return
 	}
 	var buf bytes.Buffer
-	csvWriter := csv.NewWriter(&buf)
-	for _, clan := range filter.TrackedClans {
-		csvWriter.Write([]string{
-			clan.Tag,
-			clan.Name,
-			clan.Language,
-			clan.CreationDate.String(),
-			strconv.Itoa(clan.ID),
-		})
-	}
-	csvWriter.Flush()
+	common.WriteClansCSV(&buf, filter.TrackedClans)
 	reader := bytes.NewReader(buf.Bytes())
 	file := discordgo.File{
 		Name:        "monitored_clan_list.csv",
@@ -315,6 +568,64 @@ func (bot *WowsBot) ListMonitoredClans(s *discordgo.Session, i *discordgo.Intera
 	})
 }
 
+// ExportData sends the requested data of the channel in an attached file
+func (bot *WowsBot) ExportData(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	options := i.ApplicationCommandData().Options
+	optionMap := make(map[string]*discordgo.ApplicationCommandInteractionDataOption, len(options))
+	for _, opt := range options {
+		optionMap[opt.Name] = opt
+	}
+	dataset, err := export.ParseDataset(optionMap["data"].StringValue())
+	format := export.FormatCSV
+	if opt, ok := optionMap["format"]; ok && err == nil {
+		format, err = export.ParseFormat(opt.StringValue())
+	}
+	if err != nil {
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: err.Error(),
+			},
+		})
+		return
+	}
+	scope, err := export.ChannelScope(bot.DB, i.ChannelID)
+	if err != nil {
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: "Filter doesn't seem to be set for this channel, please use '/wows-recruit-set-filter' first",
+			},
+		})
+		return
+	}
+
+	// Exports can take longer than the interaction response delay
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+	})
+	var buf bytes.Buffer
+	count, err := export.Write(bot.DB, &buf, dataset, format, scope)
+	if err != nil {
+		bot.Logger.Errorf("failed to export '%s' for channel %s: %s", dataset, i.ChannelID, err.Error())
+		s.FollowupMessageCreate(i.Interaction, true, &discordgo.WebhookParams{
+			Content: "Export failed, please retry later",
+		})
+		return
+	}
+	_, err = s.FollowupMessageCreate(i.Interaction, true, &discordgo.WebhookParams{
+		Content: fmt.Sprintf("Export of %d rows in attached file", count),
+		Files: []*discordgo.File{{
+			Name:        fmt.Sprintf("%s.%s", dataset, format),
+			ContentType: format.ContentType(),
+			Reader:      &buf,
+		}},
+	})
+	if err != nil {
+		bot.Logger.Errorf("failed to send the '%s' export to channel %s: %s", dataset, i.ChannelID, err.Error())
+	}
+}
+
 func (bot *WowsBot) ReplaceMonitoredClans(s *discordgo.Session, i *discordgo.InteractionCreate) {
 	var filter model.Filter
 	filter.DiscordChannelID = i.ChannelID
@@ -345,9 +656,8 @@ func (bot *WowsBot) ReplaceMonitoredClans(s *discordgo.Session, i *discordgo.Int
 		bot.Logger.Errorf("error downloading csv file", err)
 		return
 	}
-	//reader := bytes.NewReader(resp.Body)
-	csvReader := csv.NewReader(resp.Body)
-	records, err := csvReader.ReadAll()
+	defer resp.Body.Close()
+	clanTags, err := common.ReadClanTagsCSV(resp.Body)
 	if err != nil {
 		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 			Type: discordgo.InteractionResponseChannelMessageWithSource,
@@ -356,9 +666,9 @@ func (bot *WowsBot) ReplaceMonitoredClans(s *discordgo.Session, i *discordgo.Int
 			},
 		})
 
-		bot.Logger.Errorf("Unable to parse file as CSV", err)
+		bot.Logger.Errorf("Unable to parse file as CSV: %s", err.Error())
+		return
 	}
-	defer resp.Body.Close()
 
 	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseChannelMessageWithSource,
@@ -367,44 +677,34 @@ func (bot *WowsBot) ReplaceMonitoredClans(s *discordgo.Session, i *discordgo.Int
 		},
 	})
 
-	// Remove all tracked clans
-	bot.DB.Model(&filter).Association("TrackedClans").Delete(filter.TrackedClans)
-
-	// Add all clans in the CSV file
-	for _, line := range records {
-		if len(line) < 1 {
-			continue
-		}
-		var clan model.Clan
-		clanTag := line[0]
-		err = bot.DB.Where("tag = ?", clanTag).First(&clan).Error
-		if err != nil {
-			bot.Discord.ChannelMessageSend(i.ChannelID, "Clan ["+clanTag+"] doesn't seem to exist")
-			continue
-		}
-
-		clan.Tracked = true
-		bot.DB.Save(&clan)
-		bot.DB.Model(&filter).Association("TrackedClans").Append(&clan)
-
+	// Replace the tracked clans by the clans in the CSV file
+	missing, err := storage.ReplaceTrackedClans(bot.DB, &filter, clanTags)
+	if err != nil {
+		bot.Logger.Errorf("Failed to replace clans for channel '%s': %s", i.ChannelID, err.Error())
+	}
+	for _, clanTag := range missing {
+		bot.Discord.ChannelMessageSend(i.ChannelID, "Clan ["+clanTag+"] doesn't seem to exist")
 	}
 }
 
-func NewWowsBot(botToken string, logger *zap.SugaredLogger, db *gorm.DB, playerExitChan chan common.PlayerExitNotification, botChanOSSig chan os.Signal) *WowsBot {
+func NewWowsBot(botToken string, logger *zap.SugaredLogger, db *gorm.DB, botChanOSSig chan os.Signal) *WowsBot {
 	var bot WowsBot
-	bot.PlayerExitChan = playerExitChan
 	bot.Logger = logger
 	bot.DB = db
 	bot.OSSignal = botChanOSSig
 
 	bot.CommandHandlers = map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate){
-		"wows-recruit-test":          bot.TestOutput,
-		"wows-recruit-set-filter":    bot.SetFilter,
-		"wows-recruit-get-filter":    bot.GetFilter,
-		"wows-recruit-add-clan":      bot.AddMonitoredClan,
-		"wows-recruit-remove-clan":   bot.RemoveMonitoredClan,
-		"wows-recruit-list-clans":    bot.ListMonitoredClans,
-		"wows-recruit-replace-clans": bot.ReplaceMonitoredClans,
+		"wows-recruit-test":              bot.TestOutput,
+		"wows-recruit-set-filter":        bot.SetFilter,
+		"wows-recruit-set-cooldown":      bot.SetCooldown,
+		"wows-recruit-set-home-clan":     bot.SetHomeClan,
+		"wows-recruit-get-filter":        bot.GetFilter,
+		"wows-recruit-add-clan":          bot.AddMonitoredClan,
+		"wows-recruit-remove-clan":       bot.RemoveMonitoredClan,
+		"wows-recruit-set-clan-priority": bot.SetClanPriority,
+		"wows-recruit-list-clans":        bot.ListMonitoredClans,
+		"wows-recruit-export":            bot.ExportData,
+		"wows-recruit-replace-clans":     bot.ReplaceMonitoredClans,
 	}
 
 	// Create a new Discord session using the provided bot token.
@@ -426,91 +726,38 @@ func NewWowsBot(botToken string, logger *zap.SugaredLogger, db *gorm.DB, playerE
 		return nil
 	}
 	bot.Discord = dg
+	bot.Notifier = &DiscordNotifier{Session: dg, Logger: logger}
 
 	return &bot
 }
 
-func (bot *WowsBot) LoggedInBot(s *discordgo.Session, r *discordgo.Ready) {
-	bot.Logger.Infof("Logged in as: %v#%v", s.State.User.Username, s.State.User.Discriminator)
-}
-
-func (bot *WowsBot) SendPlayerExitMessage(player model.Player, clan model.Clan, discordChannelID string) {
-	// Calculate win rate color
-	var winRateColor int
-	switch {
-	case player.WinRate < 0.47:
-		winRateColor = 0xff0000 // Red
-	case player.WinRate < 0.49:
-		winRateColor = 0xff8c00 // Orange
-	case player.WinRate < 0.52:
-		winRateColor = 0xffff00 // Yellow
-	case player.WinRate < 0.54:
-		winRateColor = 0x00ff00 // Green
-	case player.WinRate < 0.56:
-		winRateColor = 0x006400 // Dark Green
-	case player.WinRate < 0.60:
-		winRateColor = 0x00FFFF // Cyan
-	default:
-		winRateColor = 0x800080 // Purple
-	}
-
-	// Construct message embed
-	embed := &discordgo.MessageEmbed{
-		Title: fmt.Sprintf("Player '%s' has left [%s]", common.Escape(player.Nick), common.Escape(clan.Tag)),
-		Color: winRateColor,
-		Fields: []*discordgo.MessageEmbedField{
-			{
-				Name:   "Player",
-				Value:  fmt.Sprintf("%s", common.Escape(player.Nick)),
-				Inline: true,
-			},
-			{
-				Name:   "Win Rate",
-				Value:  fmt.Sprintf("%.2f%%", player.WinRate*100),
-				Inline: true,
-			},
-			{
-				Name:   "Battles",
-				Value:  fmt.Sprintf("%d", player.Battles),
-				Inline: true,
-			},
-			{
-				Name:   "T10s",
-				Value:  fmt.Sprintf("%d", player.NumberT10),
-				Inline: true,
-			},
-			{
-				Name:   "Last Battle",
-				Value:  player.LastBattleDate.Format("2006-01-02"),
-				Inline: true,
-			},
-			{
-				Name:   "Stats",
-				Value:  fmt.Sprintf("https://wows-numbers.com/player/%d,%s/", player.ID, player.Nick),
-				Inline: true,
-			},
-		},
-		Footer: &discordgo.MessageEmbedFooter{
-			Text: "What is your opinion about this player?",
-		},
+// NewConsoleBot creates a bot writing the notifications to w instead of Discord (dry-run),
+// it goes through the outbox like the Discord bot but doesn't record the deliveries, and has no commands
+func NewConsoleBot(w io.Writer, logger *zap.SugaredLogger, db *gorm.DB, botChanOSSig chan os.Signal) *WowsBot {
+	return &WowsBot{
+		Logger:   logger,
+		DB:       db,
+		OSSignal: botChanOSSig,
+		Notifier: NewConsoleNotifier(w, logger),
+		dryRun:   true,
 	}
+}
 
-	// Send message and get message ID
-	sentMessage, err := bot.Discord.ChannelMessageSendEmbed(discordChannelID, embed)
-	if err != nil {
-		bot.Logger.Errorf("Error sending discord message: %v", err)
-		return
+// Connected reports if the Discord websocket session is open and ready, a dry-run bot is always connected
+func (bot *WowsBot) Connected() bool {
+	if bot == nil {
+		return false
 	}
-	messageID := sentMessage.ID
-
-	// Add reaction icons as poll options
-	for _, emoji := range []string{"❌", "\u2754", "✅", "🎯"} {
-		if err := bot.Discord.MessageReactionAdd(discordChannelID, messageID, emoji); err != nil {
-			bot.Logger.Errorf("Error adding reaction to message: %v", err)
-		}
+	if bot.Discord == nil {
+		return bot.dryRun
 	}
+	bot.Discord.RLock()
+	defer bot.Discord.RUnlock()
+	return bot.Discord.DataReady
+}
 
-	bot.Logger.Infof("Sent discord message <%s> on channel '%s'", embed.Title, discordChannelID)
+func (bot *WowsBot) LoggedInBot(s *discordgo.Session, r *discordgo.Ready) {
+	bot.Logger.Infof("Logged in as: %v#%v", s.State.User.Username, s.State.User.Discriminator)
 }
 
 func (bot *WowsBot) FilterMatch(filter model.Filter, player model.Player, clan model.Clan) bool {
@@ -532,6 +779,10 @@ func (bot *WowsBot) FilterMatch(filter model.Filter, player model.Player, clan m
 		bot.Logger.Debugf("Player '%s' did not match min Battles for filter '%s'", player.Nick, filter.DiscordChannelID)
 		return false
 	}
+	if filter.IgnoreJoinedClan && player.ClanID != 0 && player.ClanID != clan.ID {
+		bot.Logger.Debugf("Player '%s' already joined another clan, ignored by filter '%s'", player.Nick, filter.DiscordChannelID)
+		return false
+	}
 	for _, trackedClan := range filter.TrackedClans {
 		if trackedClan.ID == clan.ID {
 			return true
@@ -542,40 +793,301 @@ func (bot *WowsBot) FilterMatch(filter model.Filter, player model.Player, clan m
 	return false
 }
 
-func (bot *WowsBot) StartBot(wg *sync.WaitGroup) {
-	bot.Logger.Infof("Adding commands...")
-	s := bot.Discord
+// InCooldown returns true if the player was announced on the filter channel less than CooldownDays ago
+// and the player's statistics did not change materially since
+func (bot *WowsBot) InCooldown(filter model.Filter, player model.Player) bool {
+	if filter.CooldownDays <= 0 {
+		return false
+	}
+	var announcement model.Announcement
+	err := bot.DB.Where("discord_channel_id = ? AND player_id = ?", filter.DiscordChannelID, player.ID).First(&announcement).Error
+	if err != nil {
+		return false
+	}
+	if time.Since(announcement.AnnouncedAt) >= time.Duration(24*filter.CooldownDays)*time.Hour {
+		return false
+	}
+	if filter.CooldownMinWRChange > 0 && math.Abs(player.WinRate-announcement.WinRate) >= filter.CooldownMinWRChange {
+		return false
+	}
+	if filter.CooldownMinT10Change > 0 && player.NumberT10-announcement.NumberT10 >= filter.CooldownMinT10Change {
+		return false
+	}
+	bot.Logger.Debugf("Player '%s' already announced on %s for filter '%s', skipping", player.Nick, announcement.AnnouncedAt.Format("2006-01-02"), filter.DiscordChannelID)
+	return true
+}
 
-	s.AddHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) {
-		if h, ok := bot.CommandHandlers[i.ApplicationCommandData().Name]; ok {
-			h(s, i)
+// RecordAnnouncement keeps track of the player being announced on the filter channel
+func (bot *WowsBot) RecordAnnouncement(filter model.Filter, player model.Player, messageID string) {
+	if bot.dryRun {
+		return
+	}
+	announcement := &model.Announcement{
+		DiscordChannelID: filter.DiscordChannelID,
+		PlayerID:         player.ID,
+		AnnouncedAt:      time.Now(),
+		WinRate:          player.WinRate,
+		Battles:          player.Battles,
+		NumberT10:        player.NumberT10,
+		MessageID:        messageID,
+		ClanID:           player.ClanID,
+	}
+	err := bot.DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(announcement).Error
+	if err != nil {
+		bot.Logger.Errorf("Failed to record announcement of player '%s': %s", player.Nick, err.Error())
+	}
+}
+
+// saveOutboxEntry writes the state of an outbox entry, a dry-run bot leaves the DB untouched
+func (bot *WowsBot) saveOutboxEntry(entry interface{}) {
+	if bot.dryRun {
+		return
+	}
+	bot.DB.Omit(clause.Associations).Save(entry)
+}
+
+func outboxBackoff(attempts int) time.Duration {
+	backoff := time.Minute
+	for i := 1; i < attempts && backoff < outboxMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > outboxMaxBackoff {
+		return outboxMaxBackoff
+	}
+	return backoff
+}
+
+// claimOutboxEntry claims a pending entry of the outbox by pushing back its next attempt.
+// The update is conditional, so a single bot instance claims an entry.
+// A dry-run bot doesn't claim the entries, it moves its cursors past them.
+func (bot *WowsBot) claimOutboxEntry(entry interface{}, id uint) (bool, error) {
+	if bot.dryRun {
+		switch entry.(type) {
+		case *model.Notification:
+			bot.lastNotificationID = id
+		case *model.FollowUp:
+			bot.lastFollowUpID = id
 		}
-	})
+		return true, nil
+	}
+	now := time.Now()
+	result := bot.DB.Model(entry).Where("id = ? AND status = ? AND next_attempt <= ?", id, model.NotificationPending, now).
+		Update("next_attempt", now.Add(outboxLease))
+	return result.RowsAffected == 1, result.Error
+}
 
-	registeredCommands := make([]*discordgo.ApplicationCommand, len(commands))
-	for i, v := range commands {
-		cmd, err := s.ApplicationCommandCreate(s.State.User.ID, "", v)
+// DrainOutbox sends a batch of pending notifications of the outbox to the channels with a matching filter,
+// it returns the number of notifications processed
+func (bot *WowsBot) DrainOutbox() int {
+	var ids []uint
+	query := bot.DB.Model(&model.Notification{}).Where("status = ? AND next_attempt <= ?", model.NotificationPending, time.Now())
+	if bot.dryRun {
+		query = query.Where("id > ?", bot.lastNotificationID)
+	}
+	err := query.Order("id").Limit(outboxBatchSize).Pluck("id", &ids).Error
+	if err != nil {
+		bot.Logger.Errorf("Failed to load pending notifications: %s", err.Error())
+		return 0
+	}
+	if len(ids) == 0 {
+		return 0
+	}
+
+	filters := make([]model.Filter, 0)
+	bot.DB.Preload("TrackedClans").Find(&filters)
+	processed := 0
+	for _, id := range ids {
+		claimed, err := bot.claimOutboxEntry(&model.Notification{}, id)
 		if err != nil {
-			bot.Logger.Errorf("Cannot create '%v' command: %v", v.Name, err)
+			bot.Logger.Errorf("Failed to claim notification %d: %s", id, err.Error())
+			continue
 		}
-		registeredCommands[i] = cmd
+		if !claimed {
+			// Processed by another bot instance in the meantime
+			continue
+		}
+		// The deliveries are loaded once claimed, they can't change anymore
+		var notification model.Notification
+		err = bot.DB.Preload("Clan").Preload("Deliveries").First(&notification, id).Error
+		if err != nil {
+			bot.Logger.Errorf("Failed to load notification %d: %s", id, err.Error())
+			continue
+		}
+		bot.ProcessNotification(&notification, filters)
+		processed++
+	}
+	return processed
+}
+
+// ProcessNotification sends a notification to every matching channel it was not yet delivered to
+// and records the delivery status, failed deliveries are retried with an exponential backoff
+func (bot *WowsBot) ProcessNotification(notification *model.Notification, filters []model.Filter) {
+	change := common.NewPlayerExitNotification(*notification)
+	deliveries := make(map[string]*model.NotificationDelivery, len(notification.Deliveries))
+	for i := range notification.Deliveries {
+		deliveries[notification.Deliveries[i].DiscordChannelID] = &notification.Deliveries[i]
 	}
 
-	wg.Add(1)
+	notification.Attempts++
+	var lastErr error
+	for _, filter := range filters {
+		if !bot.FilterMatch(filter, change.Player, change.Clan) {
+			continue
+		}
+		delivery, ok := deliveries[filter.DiscordChannelID]
+		if ok && delivery.Status == model.NotificationSent {
+			continue
+		}
+		if !ok {
+			delivery = &model.NotificationDelivery{
+				NotificationID:   notification.ID,
+				DiscordChannelID: filter.DiscordChannelID,
+			}
+		}
+		if bot.InCooldown(filter, change.Player) {
+			delivery.Status = model.NotificationSkipped
+			bot.saveOutboxEntry(delivery)
+			continue
+		}
+		delivery.Attempts++
+		messageID, err := bot.Notifier.SendPlayerExitMessage(change, filter.DiscordChannelID)
+		if err != nil {
+			lastErr = err
+			metrics.NotificationsFailed.WithLabelValues(filter.DiscordChannelID).Inc()
+			delivery.LastError = err.Error()
+			delivery.Status = model.NotificationPending
+			if notification.Attempts >= outboxMaxAttempts {
+				delivery.Status = model.NotificationFailed
+			}
+		} else {
+			delivery.LastError = ""
+			delivery.Status = model.NotificationSent
+			delivery.MessageID = messageID
+			delivery.SentAt = time.Now()
+			metrics.NotificationsSent.WithLabelValues(filter.DiscordChannelID).Inc()
+			bot.RecordAnnouncement(filter, change.Player, messageID)
+		}
+		bot.saveOutboxEntry(delivery)
+	}
+
+	switch {
+	case lastErr == nil:
+		notification.Status = model.NotificationSent
+		notification.LastError = ""
+	case notification.Attempts >= outboxMaxAttempts:
+		bot.Logger.Errorf("Giving up on notification for player '%s' after %d attempts: %s", notification.Nick, notification.Attempts, lastErr.Error())
+		notification.Status = model.NotificationFailed
+		notification.LastError = lastErr.Error()
+	default:
+		notification.LastError = lastErr.Error()
+		notification.NextAttempt = time.Now().Add(outboxBackoff(notification.Attempts))
+	}
+	bot.saveOutboxEntry(notification)
+}
+
+func FollowUpToString(followUp model.FollowUp) string {
+	date := followUp.CreatedAt.Format("2006-01-02")
+	switch followUp.Event {
+	case model.FollowUpJoinedHomeClan:
+		return fmt.Sprintf("%s: joined our clan [%s] 🎉", date, common.Escape(followUp.ClanTag))
+	case model.FollowUpJoinedClan:
+		return fmt.Sprintf("%s: joined [%s]", date, common.Escape(followUp.ClanTag))
+	case model.FollowUpClanless:
+		return fmt.Sprintf("%s: left the clan, now clanless", date)
+	case model.FollowUpInactive:
+		return fmt.Sprintf("%s: inactive, last battle on %s", date, followUp.LastBattleDate.Format("2006-01-02"))
+	}
+	return fmt.Sprintf("%s: %s", date, followUp.Event)
+}
+
+// DrainFollowUps applies a batch of pending follow-ups to the announcement messages,
+// it returns the number of follow-ups processed
+func (bot *WowsBot) DrainFollowUps() int {
+	var followUps []model.FollowUp
+	query := bot.DB.Where("status = ? AND next_attempt <= ?", model.NotificationPending, time.Now())
+	if bot.dryRun {
+		query = query.Where("id > ?", bot.lastFollowUpID)
+	}
+	err := query.Order("id").Limit(outboxBatchSize).Find(&followUps).Error
+	if err != nil {
+		bot.Logger.Errorf("Failed to load pending follow-ups: %s", err.Error())
+		return 0
+	}
+	processed := 0
+	for _, followUp := range followUps {
+		claimed, err := bot.claimOutboxEntry(&model.FollowUp{}, followUp.ID)
+		if err != nil {
+			bot.Logger.Errorf("Failed to claim follow-up %d: %s", followUp.ID, err.Error())
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		// Reloaded once claimed, in case another bot instance attempted it in the meantime
+		err = bot.DB.First(&followUp, followUp.ID).Error
+		if err != nil {
+			bot.Logger.Errorf("Failed to load follow-up %d: %s", followUp.ID, err.Error())
+			continue
+		}
+		processed++
+		followUp.Attempts++
+		err = bot.Notifier.EditPlayerExitMessage(followUp)
+		switch {
+		case err == nil:
+			followUp.Status = model.NotificationSent
+			followUp.LastError = ""
+		case followUp.Attempts >= outboxMaxAttempts:
+			bot.Logger.Errorf("Giving up on follow-up for player '%s' after %d attempts: %s", followUp.Nick, followUp.Attempts, err.Error())
+			followUp.Status = model.NotificationFailed
+			followUp.LastError = err.Error()
+		default:
+			followUp.LastError = err.Error()
+			followUp.NextAttempt = time.Now().Add(outboxBackoff(followUp.Attempts))
+		}
+		bot.saveOutboxEntry(&followUp)
+	}
+	return processed
+}
+
+// drainOnShutdown sends the pending notifications and follow-ups until the outbox is empty or the shutdown delay is over,
+// what is left stays in the outbox for the next start
+func (bot *WowsBot) drainOnShutdown() {
+	deadline := time.Now().Add(outboxShutdownTimeout)
+	for time.Now().Before(deadline) {
+		// Failed entries are pushed back, the loop ends once only those are left
+		if bot.DrainOutbox()+bot.DrainFollowUps() == 0 {
+			return
+		}
+	}
+	bot.Logger.Warnf("Outbox not drained after %s, pending notifications are left for the next start", outboxShutdownTimeout)
+}
+
+// StartBot runs the bot until it receives a signal on OSSignal, wg must be incremented by the caller
+func (bot *WowsBot) StartBot(wg *sync.WaitGroup) {
 	defer wg.Done()
+	s := bot.Discord
+	registeredCommands := bot.addCommands()
+
 	bot.Logger.Infof("Starting main bot loop")
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	// Send what was left in the outbox by the previous run
+	bot.DrainOutbox()
+	bot.DrainFollowUps()
 	for {
 		select {
-		case change := <-bot.PlayerExitChan:
-			filters := make([]model.Filter, 0)
-			bot.DB.Preload("TrackedClans").Find(&filters)
-			for _, filter := range filters {
-				if bot.FilterMatch(filter, change.Player, change.Clan) {
-					bot.SendPlayerExitMessage(change.Player, change.Clan, filter.DiscordChannelID)
-				}
-			}
+		case <-ticker.C:
+			bot.DrainOutbox()
+			bot.DrainFollowUps()
 		case <-bot.OSSignal:
 			bot.Logger.Infof("bot received exit signal")
+			// Send the exits detected by the last scans
+			bot.Logger.Infof("Draining the outbox...")
+			bot.drainOnShutdown()
+			if s == nil {
+				return
+			}
 			bot.Logger.Infof("Removing commands...")
 
 			for _, v := range registeredCommands {
@@ -589,3 +1101,27 @@ func (bot *WowsBot) StartBot(wg *sync.WaitGroup) {
 		}
 	}
 }
+
+// addCommands registers the Discord commands, a dry-run bot has none
+func (bot *WowsBot) addCommands() []*discordgo.ApplicationCommand {
+	s := bot.Discord
+	if s == nil {
+		return nil
+	}
+	bot.Logger.Infof("Adding commands...")
+	s.AddHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		if h, ok := bot.CommandHandlers[i.ApplicationCommandData().Name]; ok {
+			h(s, i)
+		}
+	})
+
+	registeredCommands := make([]*discordgo.ApplicationCommand, len(commands))
+	for i, v := range commands {
+		cmd, err := s.ApplicationCommandCreate(s.State.User.ID, "", v)
+		if err != nil {
+			bot.Logger.Errorf("Cannot create '%v' command: %v", v.Name, err)
+		}
+		registeredCommands[i] = cmd
+	}
+	return registeredCommands
+}
@@ -0,0 +1,265 @@
+package bot
+
+import (
+	"errors"
+	"github.com/kakwa/wows-recruiting-bot/common"
+	"github.com/kakwa/wows-recruiting-bot/model"
+	"github.com/kakwa/wows-recruiting-bot/storage"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeNotifier records the messages instead of sending them, it fails if err is set
+type fakeNotifier struct {
+	err       error
+	sent      []string
+	followUps []string
+}
+
+func (notifier *fakeNotifier) SendPlayerExitMessage(change common.PlayerExitNotification, discordChannelID string) (string, error) {
+	if notifier.err != nil {
+		return "", notifier.err
+	}
+	notifier.sent = append(notifier.sent, discordChannelID+":"+change.Player.Nick)
+	return "message-" + change.Player.Nick, nil
+}
+
+func (notifier *fakeNotifier) EditPlayerExitMessage(followUp model.FollowUp) error {
+	if notifier.err != nil {
+		return notifier.err
+	}
+	notifier.followUps = append(notifier.followUps, followUp.MessageID+":"+followUp.Event)
+	return nil
+}
+
+// testBot returns a bot on a DB with a channel filtering the exits of clan 1
+func testBot(t *testing.T, notifier Notifier) *WowsBot {
+	t.Helper()
+	db := storage.OpenTestDB(t)
+	clan := model.Clan{ID: 1, Tag: "AAA"}
+	db.Create(&clan)
+	db.Create(&model.Filter{DiscordChannelID: "channel", DaysSinceLastBattle: 30, TrackedClans: []model.Clan{clan}})
+	return &WowsBot{Logger: zap.NewNop().Sugar(), DB: db, Notifier: notifier}
+}
+
+func queueExit(t *testing.T, db *gorm.DB, playerID int, nick string) *model.Notification {
+	t.Helper()
+	notification := &model.Notification{
+		PlayerID:       playerID,
+		ClanID:         1,
+		Nick:           nick,
+		WinRate:        0.55,
+		LastBattleDate: time.Now(),
+		Status:         model.NotificationPending,
+		NextAttempt:    time.Now(),
+	}
+	if err := db.Create(notification).Error; err != nil {
+		t.Fatal(err)
+	}
+	return notification
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		backoff  time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{6, 32 * time.Minute},
+		{7, time.Hour},
+		{outboxMaxAttempts, time.Hour},
+	}
+	for _, test := range tests {
+		if backoff := outboxBackoff(test.attempts); backoff != test.backoff {
+			t.Errorf("outboxBackoff(%d) = %s, expected %s", test.attempts, backoff, test.backoff)
+		}
+	}
+}
+
+func TestClaimOutboxEntry(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      string
+		nextAttempt time.Duration
+		claimed     bool
+	}{
+		{name: "due", status: model.NotificationPending, claimed: true},
+		{name: "backing off", status: model.NotificationPending, nextAttempt: time.Minute},
+		{name: "sent", status: model.NotificationSent},
+		{name: "failed", status: model.NotificationFailed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bot := testBot(t, &fakeNotifier{})
+			notification := queueExit(t, bot.DB, 10, "player")
+			bot.DB.Model(notification).Updates(map[string]interface{}{"status": test.status, "next_attempt": time.Now().Add(test.nextAttempt)})
+			claimed, err := bot.claimOutboxEntry(&model.Notification{}, notification.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claimed != test.claimed {
+				t.Fatalf("claimed = %t, expected %t", claimed, test.claimed)
+			}
+			// Another instance can't claim it again during the lease
+			if claimed, _ := bot.claimOutboxEntry(&model.Notification{}, notification.ID); claimed {
+				t.Fatal("entry claimed twice")
+			}
+		})
+	}
+}
+
+func TestDrainOutbox(t *testing.T) {
+	notifier := &fakeNotifier{}
+	bot := testBot(t, notifier)
+	queueExit(t, bot.DB, 10, "first")
+	queueExit(t, bot.DB, 11, "second")
+
+	if processed := bot.DrainOutbox(); processed != 2 {
+		t.Fatalf("processed %d notifications, expected 2", processed)
+	}
+	if processed := bot.DrainOutbox(); processed != 0 {
+		t.Fatalf("processed %d notifications again", processed)
+	}
+	if strings.Join(notifier.sent, ",") != "channel:first,channel:second" {
+		t.Fatalf("unexpected messages %v", notifier.sent)
+	}
+	var pending int64
+	bot.DB.Model(&model.Notification{}).Where("status != ?", model.NotificationSent).Count(&pending)
+	if pending != 0 {
+		t.Fatalf("%d notifications not marked sent", pending)
+	}
+	var announcement model.Announcement
+	if err := bot.DB.First(&announcement, "player_id = ?", 10).Error; err != nil || announcement.MessageID != "message-first" {
+		t.Fatalf("announcement not recorded: %+v, %v", announcement, err)
+	}
+}
+
+func TestDrainOutboxFailure(t *testing.T) {
+	notifier := &fakeNotifier{err: errors.New("discord unreachable")}
+	bot := testBot(t, notifier)
+	notification := queueExit(t, bot.DB, 10, "player")
+
+	start := time.Now()
+	bot.DrainOutbox()
+	bot.DB.First(notification, notification.ID)
+	if notification.Status != model.NotificationPending || notification.Attempts != 1 || notification.LastError != "discord unreachable" {
+		t.Fatalf("unexpected notification after a failure: %+v", notification)
+	}
+	// Retried after the backoff, not on the next drain
+	if notification.NextAttempt.Before(start.Add(outboxBackoff(1))) {
+		t.Fatalf("next attempt at %s, before the backoff", notification.NextAttempt)
+	}
+	if processed := bot.DrainOutbox(); processed != 0 {
+		t.Fatal("notification retried before the backoff")
+	}
+
+	// Given up after the last attempt
+	bot.DB.Model(notification).Updates(map[string]interface{}{"attempts": outboxMaxAttempts - 1, "next_attempt": time.Now()})
+	bot.DrainOutbox()
+	bot.DB.First(notification, notification.ID)
+	if notification.Status != model.NotificationFailed {
+		t.Fatalf("notification status %s after %d attempts", notification.Status, notification.Attempts)
+	}
+}
+
+func TestDrainFollowUps(t *testing.T) {
+	notifier := &fakeNotifier{}
+	bot := testBot(t, notifier)
+	bot.DB.Create(&model.FollowUp{
+		DiscordChannelID: "channel",
+		MessageID:        "message",
+		Event:            model.FollowUpClanless,
+		Status:           model.NotificationPending,
+		NextAttempt:      time.Now(),
+	})
+	if processed := bot.DrainFollowUps(); processed != 1 {
+		t.Fatalf("processed %d follow-ups, expected 1", processed)
+	}
+	if processed := bot.DrainFollowUps(); processed != 0 {
+		t.Fatalf("processed %d follow-ups again", processed)
+	}
+	if strings.Join(notifier.followUps, ",") != "message:clanless" {
+		t.Fatalf("unexpected follow-ups %v", notifier.followUps)
+	}
+}
+
+func TestDrainOutboxDryRun(t *testing.T) {
+	var out strings.Builder
+	bot := testBot(t, nil)
+	bot.Notifier = NewConsoleNotifier(&out, bot.Logger)
+	bot.dryRun = true
+	notification := queueExit(t, bot.DB, 10, "player")
+
+	if processed := bot.DrainOutbox(); processed != 1 {
+		t.Fatalf("processed %d notifications, expected 1", processed)
+	}
+	// Written once per process, without touching the DB
+	if processed := bot.DrainOutbox(); processed != 0 {
+		t.Fatalf("processed %d notifications again", processed)
+	}
+	expectedID := `"message_id":"dry-run-` + strconv.Itoa(int(notification.ID)) + `-channel"`
+	if strings.Count(out.String(), "\n") != 1 || !strings.Contains(out.String(), expectedID) {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+	var saved model.Notification
+	bot.DB.First(&saved, notification.ID)
+	if saved.Status != model.NotificationPending || saved.Attempts != 0 || !saved.NextAttempt.Equal(notification.NextAttempt) {
+		t.Fatalf("notification updated by the dry-run: %+v", saved)
+	}
+	var count int64
+	bot.DB.Model(&model.Announcement{}).Count(&count)
+	if count != 0 {
+		t.Fatal("announcement recorded by the dry-run")
+	}
+}
+
+func TestInCooldown(t *testing.T) {
+	filter := model.Filter{DiscordChannelID: "channel", CooldownDays: 7, CooldownMinWRChange: 0.02, CooldownMinT10Change: 3}
+	announced := model.Announcement{DiscordChannelID: "channel", PlayerID: 1, WinRate: 0.55, NumberT10: 5}
+	player := model.Player{ID: 1, Nick: "player", WinRate: 0.55, NumberT10: 5}
+	tests := []struct {
+		name string
+		// Age of the announcement, not announced if zero
+		announcedAgo time.Duration
+		filter       func(filter *model.Filter)
+		player       func(player *model.Player)
+		inCooldown   bool
+	}{
+		{name: "announced recently", announcedAgo: 24 * time.Hour, inCooldown: true},
+		{name: "not announced"},
+		{name: "no cooldown", announcedAgo: 24 * time.Hour, filter: func(filter *model.Filter) { filter.CooldownDays = 0 }},
+		{name: "cooldown over", announcedAgo: 10 * 24 * time.Hour},
+		{name: "win rate changed", announcedAgo: 24 * time.Hour, player: func(player *model.Player) { player.WinRate = 0.52 }},
+		{name: "small win rate change", announcedAgo: 24 * time.Hour, player: func(player *model.Player) { player.WinRate = 0.56 }, inCooldown: true},
+		{name: "new T10s", announcedAgo: 24 * time.Hour, player: func(player *model.Player) { player.NumberT10 = 8 }},
+		{name: "no T10 change check", announcedAgo: 24 * time.Hour, filter: func(filter *model.Filter) { filter.CooldownMinT10Change = 0 }, player: func(player *model.Player) { player.NumberT10 = 8 }, inCooldown: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bot := &WowsBot{Logger: zap.NewNop().Sugar(), DB: storage.OpenTestDB(t)}
+			if test.announcedAgo != 0 {
+				announcement := announced
+				announcement.AnnouncedAt = time.Now().Add(-test.announcedAgo)
+				if err := bot.DB.Create(&announcement).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+			filter, player := filter, player
+			if test.filter != nil {
+				test.filter(&filter)
+			}
+			if test.player != nil {
+				test.player(&player)
+			}
+			if inCooldown := bot.InCooldown(filter, player); inCooldown != test.inCooldown {
+				t.Errorf("InCooldown = %t, expected %t", inCooldown, test.inCooldown)
+			}
+		})
+	}
+}
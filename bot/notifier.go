@@ -0,0 +1,234 @@
+package bot
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/kakwa/wows-recruiting-bot/common"
+	"github.com/kakwa/wows-recruiting-bot/model"
+	"go.uber.org/zap"
+	"io"
+	"sync"
+	"time"
+)
+
+// Notifier delivers the exit notifications and their follow-ups to the channels
+type Notifier interface {
+	// SendPlayerExitMessage announces an exit on a channel, it returns the ID of the message
+	SendPlayerExitMessage(change common.PlayerExitNotification, discordChannelID string) (string, error)
+	// EditPlayerExitMessage adds a follow-up to the announcement of an exit
+	EditPlayerExitMessage(followUp model.FollowUp) error
+}
+
+// ExitTitle describes an exit in one line
+func ExitTitle(change common.PlayerExitNotification) string {
+	destination := "now clanless"
+	if change.NewClan != nil {
+		destination = fmt.Sprintf("now in [%s]", common.Escape(change.NewClan.Tag))
+	}
+	return fmt.Sprintf("Player '%s' left [%s], %s", common.Escape(change.Player.Nick), common.Escape(change.Clan.Tag), destination)
+}
+
+// DiscordNotifier sends the notifications as Discord messages
+type DiscordNotifier struct {
+	Session *discordgo.Session
+	Logger  *zap.SugaredLogger
+}
+
+func (notifier *DiscordNotifier) SendPlayerExitMessage(change common.PlayerExitNotification, discordChannelID string) (string, error) {
+	player := change.Player
+
+	// Calculate win rate color
+	var winRateColor int
+	switch {
+	case player.WinRate < 0.47:
+		winRateColor = 0xff0000 // Red
+	case player.WinRate < 0.49:
+		winRateColor = 0xff8c00 // Orange
+	case player.WinRate < 0.52:
+		winRateColor = 0xffff00 // Yellow
+	case player.WinRate < 0.54:
+		winRateColor = 0x00ff00 // Green
+	case player.WinRate < 0.56:
+		winRateColor = 0x006400 // Dark Green
+	case player.WinRate < 0.60:
+		winRateColor = 0x00FFFF // Cyan
+	default:
+		winRateColor = 0x800080 // Purple
+	}
+
+	// Construct message embed
+	embed := &discordgo.MessageEmbed{
+		Title: ExitTitle(change),
+		Color: winRateColor,
+		Fields: []*discordgo.MessageEmbedField{
+			{
+				Name:   "Player",
+				Value:  fmt.Sprintf("%s", common.Escape(player.Nick)),
+				Inline: true,
+			},
+			{
+				Name:   "Win Rate",
+				Value:  fmt.Sprintf("%.2f%%", player.WinRate*100),
+				Inline: true,
+			},
+			{
+				Name:   "Battles",
+				Value:  fmt.Sprintf("%d", player.Battles),
+				Inline: true,
+			},
+			{
+				Name:   "T10s",
+				Value:  fmt.Sprintf("%d", player.NumberT10),
+				Inline: true,
+			},
+			{
+				Name:   "Last Battle",
+				Value:  player.LastBattleDate.Format("2006-01-02"),
+				Inline: true,
+			},
+			{
+				Name:   "Stats",
+				Value:  fmt.Sprintf("https://wows-numbers.com/player/%d,%s/", player.ID, player.Nick),
+				Inline: true,
+			},
+		},
+		Footer: &discordgo.MessageEmbedFooter{
+			Text: "What is your opinion about this player?",
+		},
+	}
+
+	// Send message and get message ID
+	sentMessage, err := notifier.Session.ChannelMessageSendEmbed(discordChannelID, embed)
+	if err != nil {
+		notifier.Logger.Errorf("Error sending discord message: %v", err)
+		return "", err
+	}
+	messageID := sentMessage.ID
+
+	// Add reaction icons as poll options
+	for _, emoji := range []string{"❌", "\u2754", "✅", "🎯"} {
+		if err := notifier.Session.MessageReactionAdd(discordChannelID, messageID, emoji); err != nil {
+			notifier.Logger.Errorf("Error adding reaction to message: %v", err)
+		}
+	}
+
+	notifier.Logger.Infof("Sent discord message <%s> on channel '%s'", embed.Title, discordChannelID)
+	return messageID, nil
+}
+
+// EditPlayerExitMessage adds the follow-up to the "Update" field of the original announcement
+func (notifier *DiscordNotifier) EditPlayerExitMessage(followUp model.FollowUp) error {
+	message, err := notifier.Session.ChannelMessage(followUp.DiscordChannelID, followUp.MessageID)
+	if err != nil {
+		return err
+	}
+	if len(message.Embeds) == 0 {
+		return fmt.Errorf("message %s has no embed", followUp.MessageID)
+	}
+	embed := message.Embeds[0]
+	update := FollowUpToString(followUp)
+	var updateField *discordgo.MessageEmbedField
+	for _, field := range embed.Fields {
+		if field.Name == "Update" {
+			updateField = field
+		}
+	}
+	if updateField == nil {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Update", Value: update})
+	} else {
+		updateField.Value = updateField.Value + "\n" + update
+	}
+	_, err = notifier.Session.ChannelMessageEditEmbed(followUp.DiscordChannelID, followUp.MessageID, embed)
+	if err != nil {
+		return err
+	}
+	notifier.Logger.Infof("Updated discord message %s on channel '%s': %s", followUp.MessageID, followUp.DiscordChannelID, update)
+	return nil
+}
+
+// ConsoleNotifier writes the notifications as JSON lines instead of sending them, to try the filters without Discord
+type ConsoleNotifier struct {
+	Logger *zap.SugaredLogger
+
+	lock sync.Mutex
+	out  *json.Encoder
+}
+
+func NewConsoleNotifier(w io.Writer, logger *zap.SugaredLogger) *ConsoleNotifier {
+	return &ConsoleNotifier{Logger: logger, out: json.NewEncoder(w)}
+}
+
+// consoleEvent is a line written by the ConsoleNotifier
+type consoleEvent struct {
+	Event            string     `json:"event"`
+	DiscordChannelID string     `json:"channel_id"`
+	MessageID        string     `json:"message_id"`
+	Title            string     `json:"title"`
+	PlayerID         int        `json:"player_id"`
+	Nick             string     `json:"nick"`
+	WinRate          float64    `json:"win_rate,omitempty"`
+	Battles          int        `json:"battles,omitempty"`
+	NumberT10        int        `json:"number_t10,omitempty"`
+	LastBattleDate   *time.Time `json:"last_battle_date,omitempty"`
+	HiddenProfile    bool       `json:"hidden_profile,omitempty"`
+	ClanID           int        `json:"clan_id,omitempty"`
+	ClanTag          string     `json:"clan_tag,omitempty"`
+	NewClanID        int        `json:"new_clan_id,omitempty"`
+	NewClanTag       string     `json:"new_clan_tag,omitempty"`
+}
+
+func (notifier *ConsoleNotifier) write(event consoleEvent) error {
+	notifier.lock.Lock()
+	defer notifier.lock.Unlock()
+	return notifier.out.Encode(event)
+}
+
+func (notifier *ConsoleNotifier) SendPlayerExitMessage(change common.PlayerExitNotification, discordChannelID string) (string, error) {
+	player := change.Player
+	event := consoleEvent{
+		Event:            "exit",
+		DiscordChannelID: discordChannelID,
+		// Derived from the notification so that replays write the same IDs
+		MessageID:      fmt.Sprintf("dry-run-%d-%s", change.NotificationID, discordChannelID),
+		Title:          ExitTitle(change),
+		PlayerID:       player.ID,
+		Nick:           player.Nick,
+		WinRate:        player.WinRate,
+		Battles:        player.Battles,
+		NumberT10:      player.NumberT10,
+		LastBattleDate: &player.LastBattleDate,
+		HiddenProfile:  player.HiddenProfile,
+		ClanID:         change.Clan.ID,
+		ClanTag:        change.Clan.Tag,
+	}
+	if change.NewClan != nil {
+		event.NewClanID = change.NewClan.ID
+		event.NewClanTag = change.NewClan.Tag
+	}
+	err := notifier.write(event)
+	if err != nil {
+		return "", err
+	}
+	notifier.Logger.Infof("Dry-run, not sent on channel '%s': <%s>", discordChannelID, event.Title)
+	return event.MessageID, nil
+}
+
+func (notifier *ConsoleNotifier) EditPlayerExitMessage(followUp model.FollowUp) error {
+	update := FollowUpToString(followUp)
+	err := notifier.write(consoleEvent{
+		Event:            "follow_up",
+		DiscordChannelID: followUp.DiscordChannelID,
+		MessageID:        followUp.MessageID,
+		Title:            update,
+		PlayerID:         followUp.PlayerID,
+		Nick:             followUp.Nick,
+		ClanID:           followUp.ClanID,
+		ClanTag:          followUp.ClanTag,
+	})
+	if err != nil {
+		return err
+	}
+	notifier.Logger.Infof("Dry-run, message %s not updated on channel '%s': %s", followUp.MessageID, followUp.DiscordChannelID, update)
+	return nil
+}
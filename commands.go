@@ -0,0 +1,844 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/kakwa/wows-recruiting-bot/backend"
+	"github.com/kakwa/wows-recruiting-bot/bot"
+	"github.com/kakwa/wows-recruiting-bot/common"
+	"github.com/kakwa/wows-recruiting-bot/config"
+	"github.com/kakwa/wows-recruiting-bot/export"
+	"github.com/kakwa/wows-recruiting-bot/model"
+	"github.com/kakwa/wows-recruiting-bot/storage"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"moul.io/zapgorm2"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+var ErrUsage = errors.New("invalid command usage")
+
+// app holds the resources shared by the commands
+type app struct {
+	// Cancelled on SIGINT/SIGTERM
+	ctx     context.Context
+	cfg     *config.Config
+	logger  *zap.SugaredLogger
+	glogger zapgorm2.Logger
+	db      *gorm.DB
+	backend *backend.Backend
+}
+
+// command is a CLI subcommand, run receives the arguments following the command name
+type command struct {
+	usage       string
+	description string
+	// The configuration is validated before running the command
+	validate bool
+	run      func(app *app, args []string) error
+}
+
+var commands = map[string]command{
+	"serve": {
+		usage:       "serve",
+		description: "run the bot (default command)",
+		validate:    true,
+		run:         cmdServe,
+	},
+	"scan": {
+		usage:       "scan all|monitored|shard [INDEX]|clan <TAG>...",
+		description: "update all the clans, the monitored clans, a shard of the rolling full scan (default: today's) or the given clans",
+		validate:    true,
+		run:         cmdScan,
+	},
+	"schedule": {
+		usage:       "schedule",
+		description: "display the scan schedule of the monitored clans",
+		run:         cmdSchedule,
+	},
+	"player": {
+		usage:       "player show <NICK>",
+		description: "display a player, the player's previous clans and announcements",
+		run:         cmdPlayer,
+	},
+	"filter": {
+		usage:       "filter list|set <CHANNEL ID> [options]",
+		description: "list the filters or set the filter of a Discord channel",
+		run:         cmdFilter,
+	},
+	"clans": {
+		usage:       "clans list|import|add|remove|priority <CHANNEL ID> [file.csv|TAG] [high|normal|low]",
+		description: "manage the clans monitored by the filter of a Discord channel and their scan priority",
+		run:         cmdClans,
+	},
+	"export": {
+		usage:       "export players|previous-clans|exits|roster|tracked-clans|notifications [-format csv|jsonl|parquet] [-o file] [-channel ID] [TAG...]",
+		description: "export the players, the previous clans, the exits matched by the filters, the clan rosters, the monitored clans or the exit notifications",
+		run:         cmdExport,
+	},
+	"config": {
+		usage:       "config check",
+		description: "validate the configuration",
+		validate:    true,
+		run:         cmdConfig,
+	},
+	"migrate": {
+		usage:       "migrate [status]",
+		description: "apply (or list) the pending DB migrations",
+		run:         cmdMigrate,
+	},
+	"backup": {
+		usage:       "backup [-dir <directory>]",
+		description: "back up the SQLite DB while the bot is running",
+		run:         cmdBackup,
+	},
+	"restore": {
+		usage:       "restore <BACKUP FILE>",
+		description: "replace the SQLite DB by a backup (the bot must be stopped)",
+		run:         cmdRestore,
+	},
+	"notify": {
+		usage:       "notify test [CHANNEL ID]",
+		description: "send a fake exit of a random player to a Discord channel, or to stdout in dry-run",
+		run:         cmdNotify,
+	},
+	"usage": {
+		usage:       "usage [-days N]",
+		description: "display the daily Wargaming API requests by job and application ID",
+		run:         cmdUsage,
+	},
+	"prune": {
+		usage:       "prune [-dry-run]",
+		description: "delete the data older than the retention policy",
+		run:         cmdPrune,
+	},
+	"token": {
+		usage:       "token list|create <GUILD ID> <NAME>|revoke <ID>",
+		description: "manage the REST API tokens of the Discord guilds",
+		run:         cmdToken,
+	},
+	"copy-db": {
+		usage:       "copy-db <source DSN> <dest DSN>",
+		description: "copy the DB content to another DB backend",
+		run:         cmdCopyDB,
+	},
+}
+
+// openDB connects to the DB and applies the pending migrations
+func (app *app) openDB() error {
+	if app.db != nil {
+		return nil
+	}
+	db, err := storage.Open(app.cfg.DBDSN, &gorm.Config{Logger: app.glogger})
+	if err != nil {
+		return fmt.Errorf("failed to connect database: %w", err)
+	}
+	err = storage.Migrate(db, app.logger.With("component", "storage"))
+	if err != nil {
+		return err
+	}
+	app.db = db
+	return nil
+}
+
+// openBackend creates the backend querying the Wargaming API, the configuration must have been validated
+func (app *app) openBackend() error {
+	if app.backend != nil {
+		return nil
+	}
+	err := app.openDB()
+	if err != nil {
+		return err
+	}
+	traffic := app.cfg.Wows.Traffic
+	keys := app.cfg.Wows.Keys()
+	if len(keys) == 0 && traffic.Mode == backend.TrafficReplay {
+		// Never sent, the recorded requests are matched without their application ID
+		keys = []string{"replay"}
+	}
+	api, err := backend.NewBackend(keys, app.cfg.Wows.Realm, app.cfg.Wows.HTTPTimeout, app.cfg.DetectionLanguages(), app.logger.With("component", "backend"), app.db)
+	if err != nil {
+		return err
+	}
+	switch traffic.Mode {
+	case backend.TrafficRecord:
+		recorder, err := backend.NewTrafficRecorder(traffic.Dir, nil)
+		if err != nil {
+			return fmt.Errorf("failed to record the API traffic: %w", err)
+		}
+		api.SetAPITransport(recorder)
+		app.logger.Infof("recording the API traffic in '%s'", traffic.Dir)
+	case backend.TrafficReplay:
+		replayer, err := backend.NewTrafficReplayer(traffic.Dir)
+		if err != nil {
+			return fmt.Errorf("failed to replay the API traffic: %w", err)
+		}
+		api.SetAPITransport(replayer)
+		app.logger.Infof("replaying the API traffic recorded in '%s'", traffic.Dir)
+	}
+	api.ExitGracePeriod = app.cfg.Scan.ExitGracePeriod
+	api.ScanIntervals = app.cfg.Scan.ScanIntervals()
+	api.MaxClansPerMinute = app.cfg.Scan.MaxClansPerMinute
+	api.Adaptive = app.cfg.Scan.Adaptive.AdaptiveIntervals()
+	api.FullScanShards = app.cfg.Scan.FullScanEveryDays
+	api.TopTier = app.cfg.Wows.TopTier
+	// The cached responses would be missing from a recording or differ from it
+	if app.cfg.Wows.Cache.Enabled && traffic.Mode == backend.TrafficLive {
+		cache, err := backend.NewAPICache(app.cfg.Wows.Cache.TTLs, app.cfg.Wows.Cache.MaxEntries, app.cfg.Wows.Cache.Dir)
+		if err != nil {
+			return fmt.Errorf("failed to create the API cache: %w", err)
+		}
+		api.SetAPICache(cache)
+	}
+	err = api.FillShipMapping(app.ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load the ship list: %w", err)
+	}
+	app.backend = api
+	return nil
+}
+
+// newBot creates the bot delivering the notifications, to Discord or to stdout in dry-run
+func (app *app) newBot(botChanOSSig chan os.Signal) (*bot.WowsBot, error) {
+	logger := app.logger.With("component", "discord_bot")
+	if app.cfg.Discord.DryRun {
+		logger.Infof("Dry-run, the notifications are written to stdout instead of Discord")
+		return bot.NewConsoleBot(os.Stdout, logger, app.db, botChanOSSig), nil
+	}
+	disbot := bot.NewWowsBot(app.cfg.Discord.Token, logger, app.db, botChanOSSig)
+	if disbot == nil {
+		return nil, errors.New("failed to connect to Discord")
+	}
+	return disbot, nil
+}
+
+func cmdServe(app *app, args []string) error {
+	if len(args) != 0 {
+		return ErrUsage
+	}
+	err := app.cfg.ValidateDiscord()
+	if err != nil {
+		return err
+	}
+	err = app.openBackend()
+	if err != nil {
+		return err
+	}
+	return serve(app)
+}
+
+func cmdScan(app *app, args []string) error {
+	if len(args) < 1 {
+		return ErrUsage
+	}
+	err := app.openBackend()
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "all":
+		return app.backend.ScrapAllClans(app.ctx)
+	case "monitored":
+		return app.backend.ScrapMonitoredClans(app.ctx)
+	case "shard":
+		if len(args) > 2 {
+			return ErrUsage
+		}
+		shard := backend.RollingShard(time.Now(), app.backend.FullScanShards)
+		if len(args) == 2 {
+			// Shards are numbered from 1 in the logs and the command line
+			index, err := strconv.Atoi(args[1])
+			if err != nil || index < 1 || index > app.backend.FullScanShards {
+				return fmt.Errorf("invalid shard '%s', expected 1 to %d", args[1], app.backend.FullScanShards)
+			}
+			shard = index - 1
+		}
+		return app.backend.ScrapClanShard(app.ctx, shard)
+	case "clan":
+		if len(args) < 2 {
+			return ErrUsage
+		}
+		var ids []int
+		for _, clanTag := range args[1:] {
+			clan, err := storage.GetClanByTag(app.db, clanTag)
+			if err != nil {
+				return fmt.Errorf("clan [%s]: %w", clanTag, err)
+			}
+			ids = append(ids, clan.ID)
+		}
+		return app.backend.ScanClans(app.ctx, ids)
+	}
+	return ErrUsage
+}
+
+// formatDate formats a date which may be unknown
+func formatDate(date time.Time) string {
+	if date.IsZero() {
+		return "unknown"
+	}
+	return date.Format("2006-01-02")
+}
+
+func cmdPlayer(app *app, args []string) error {
+	if len(args) != 2 || args[0] != "show" {
+		return ErrUsage
+	}
+	err := app.openDB()
+	if err != nil {
+		return err
+	}
+	var player model.Player
+	err = app.db.Preload("PreviousClans.Clan").Where("nick = ?", args[1]).First(&player).Error
+	if err != nil {
+		return fmt.Errorf("player '%s': %w", args[1], err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	clanTag := "clanless"
+	var clan model.Clan
+	if player.ClanID != 0 && app.db.First(&clan, player.ClanID).Error == nil {
+		clanTag = "[" + clan.Tag + "]"
+	}
+	fmt.Fprintf(w, "Player:\t%s (%d)\n", player.Nick, player.ID)
+	fmt.Fprintf(w, "Clan:\t%s since %s\n", clanTag, formatDate(player.ClanJoinDate))
+	fmt.Fprintf(w, "Win Rate:\t%.2f%%\n", player.WinRate*100)
+	fmt.Fprintf(w, "Battles:\t%d\n", player.Battles)
+	fmt.Fprintf(w, "T10s:\t%d\n", player.NumberT10)
+	fmt.Fprintf(w, "Hidden profile:\t%t\n", player.HiddenProfile)
+	fmt.Fprintf(w, "Account creation:\t%s\n", player.AccountCreationDate.Format("2006-01-02"))
+	fmt.Fprintf(w, "Last battle:\t%s\n", player.LastBattleDate.Format("2006-01-02"))
+	fmt.Fprintf(w, "Last update:\t%s\n", player.UpdatedAt.Format("2006-01-02 15:04"))
+	for _, previousClan := range player.PreviousClans {
+		previousTag := strconv.Itoa(previousClan.ClanID)
+		if previousClan.Clan != nil {
+			previousTag = previousClan.Clan.Tag
+		}
+		fmt.Fprintf(w, "Previous clan:\t[%s] %s -> %s\n", previousTag, formatDate(previousClan.JoinDate), previousClan.LeaveDate.Format("2006-01-02"))
+	}
+	var announcements []model.Announcement
+	app.db.Where("player_id = ?", player.ID).Find(&announcements)
+	for _, announcement := range announcements {
+		fmt.Fprintf(w, "Announced:\ton channel %s on %s\n", announcement.DiscordChannelID, announcement.AnnouncedAt.Format("2006-01-02 15:04"))
+	}
+	return w.Flush()
+}
+
+func cmdFilter(app *app, args []string) error {
+	if len(args) < 1 {
+		return ErrUsage
+	}
+	err := app.openDB()
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "list":
+		var filters []model.Filter
+		err = app.db.Preload("TrackedClans").Find(&filters).Error
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "CHANNEL\tGUILD\tCLANS\tFILTER\n")
+		for _, filter := range filters {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", filter.DiscordChannelID, filter.DiscordGuildID, len(filter.TrackedClans), bot.FilterToString(filter))
+		}
+		return w.Flush()
+	case "set":
+		if len(args) < 2 {
+			return ErrUsage
+		}
+		filter := model.Filter{DiscordChannelID: args[1]}
+		existing, err := storage.GetFilter(app.db, args[1])
+		if err == nil {
+			filter = *existing
+		}
+		var minWR int
+		flags := flag.NewFlagSet("filter set", flag.ContinueOnError)
+		flags.StringVar(&filter.DiscordGuildID, "guild", filter.DiscordGuildID, "Discord guild (server) ID of the channel")
+		flags.IntVar(&filter.MinNumT10, "min-t10", filter.MinNumT10, "minimum number of T10s")
+		flags.IntVar(&filter.DaysSinceLastBattle, "max-days-last-battle", filter.DaysSinceLastBattle, "number of days since last battle")
+		flags.IntVar(&filter.MinNumBattles, "min-battles", filter.MinNumBattles, "minimum number of battles")
+		flags.IntVar(&minWR, "min-winrate", int(filter.MinPlayerWR*100), "minimum Win Rate (percent)")
+		flags.BoolVar(&filter.IgnoreJoinedClan, "ignore-joined-clan", filter.IgnoreJoinedClan, "ignore players who already joined another clan")
+		err = flags.Parse(args[2:])
+		if err != nil {
+			return ErrUsage
+		}
+		filter.MinPlayerWR = float64(minWR) / 100
+		err = storage.SaveFilterCriterias(app.db, &filter)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Set filter to: " + bot.FilterToString(filter))
+		return nil
+	}
+	return ErrUsage
+}
+
+func cmdSchedule(app *app, args []string) error {
+	if len(args) != 0 {
+		return ErrUsage
+	}
+	err := app.openDB()
+	if err != nil {
+		return err
+	}
+	// The schedule only needs the DB
+	now := time.Now()
+	schedules, err := backend.ClanSchedules(app.db, app.cfg.Scan.ScanIntervals(), app.cfg.Scan.Adaptive.AdaptiveIntervals(), now)
+	if err != nil {
+		return err
+	}
+	var clans []model.Clan
+	err = app.db.Where("tracked = ?", true).Find(&clans).Error
+	if err != nil {
+		return err
+	}
+	tags := make(map[int]string, len(clans))
+	for _, clan := range clans {
+		tags[clan.ID] = clan.Tag
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "TAG\tPRIORITY\tEXITS (%dD)\tINTERVAL\tLAST SCAN\tNEXT SCAN\n", app.cfg.Scan.Adaptive.ChurnWindowDays)
+	for _, schedule := range schedules {
+		lastScan := "never"
+		if !schedule.LastScan.IsZero() {
+			lastScan = schedule.LastScan.Format("2006-01-02 15:04")
+		}
+		nextScan := "due"
+		if schedule.NextScan.After(now) {
+			nextScan = schedule.NextScan.Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", tags[schedule.ClanID], schedule.Priority, schedule.Churn, schedule.Interval.Round(time.Minute), lastScan, nextScan)
+	}
+	return w.Flush()
+}
+
+func cmdClans(app *app, args []string) error {
+	if len(args) < 2 {
+		return ErrUsage
+	}
+	err := app.openDB()
+	if err != nil {
+		return err
+	}
+	filter, err := storage.GetFilter(app.db, args[1])
+	if err != nil {
+		return err
+	}
+	switch {
+	case args[0] == "list" && len(args) == 2:
+		return common.WriteClansCSV(os.Stdout, filter.TrackedClans)
+	case args[0] == "priority" && len(args) == 2:
+		priorities, err := storage.FilterClanPriorities(app.db, filter.DiscordChannelID)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "TAG\tPRIORITY\n")
+		for _, clan := range filter.TrackedClans {
+			priority, ok := priorities[clan.ID]
+			if !ok {
+				priority = model.PriorityNormal
+			}
+			fmt.Fprintf(w, "%s\t%s\n", clan.Tag, priority)
+		}
+		return w.Flush()
+	case args[0] == "priority" && len(args) == 4:
+		_, err = storage.SetClanPriority(app.db, filter, args[2], args[3])
+		if err != nil {
+			return fmt.Errorf("clan [%s]: %w", args[2], err)
+		}
+		fmt.Printf("Clan [%s] scanned with %s priority\n", args[2], args[3])
+		return nil
+	case args[0] == "import" && len(args) == 3:
+		file, err := os.Open(args[2])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		clanTags, err := common.ReadClanTagsCSV(file)
+		if err != nil {
+			return err
+		}
+		missing, err := storage.ReplaceTrackedClans(app.db, filter, clanTags)
+		for _, clanTag := range missing {
+			fmt.Printf("Clan [%s] doesn't seem to exist\n", clanTag)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d clans monitored\n", len(clanTags)-len(missing))
+		return nil
+	case args[0] == "add" && len(args) == 3:
+		_, err = storage.TrackClan(app.db, filter, args[2])
+		if err != nil {
+			return fmt.Errorf("clan [%s]: %w", args[2], err)
+		}
+		fmt.Printf("Clan [%s] added\n", args[2])
+		return nil
+	case args[0] == "remove" && len(args) == 3:
+		_, err = storage.UntrackClan(app.db, filter, args[2])
+		if err != nil {
+			return fmt.Errorf("clan [%s]: %w", args[2], err)
+		}
+		fmt.Printf("Clan [%s] removed\n", args[2])
+		return nil
+	}
+	return ErrUsage
+}
+
+func cmdExport(app *app, args []string) error {
+	if len(args) < 1 {
+		return ErrUsage
+	}
+	dataset, err := export.ParseDataset(args[0])
+	if err != nil {
+		return ErrUsage
+	}
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	output := flags.String("o", "-", "output file ('-' for stdout)")
+	formatName := flags.String("format", string(export.FormatCSV), "output format: csv, jsonl or parquet")
+	channelID := flags.String("channel", "", "restrict to the filter of a Discord channel and its monitored clans")
+	err = flags.Parse(args[1:])
+	if err != nil {
+		return ErrUsage
+	}
+	format, err := export.ParseFormat(*formatName)
+	if err != nil {
+		return err
+	}
+	err = app.openDB()
+	if err != nil {
+		return err
+	}
+
+	var scope export.Scope
+	if *channelID != "" {
+		scope, err = export.ChannelScope(app.db, *channelID)
+		if err != nil {
+			return err
+		}
+	}
+	if flags.NArg() != 0 {
+		scope.ClanIDs = []int{}
+		for _, clanTag := range flags.Args() {
+			clan, err := storage.GetClanByTag(app.db, clanTag)
+			if err != nil {
+				return fmt.Errorf("clan [%s]: %w", clanTag, err)
+			}
+			scope.ClanIDs = append(scope.ClanIDs, clan.ID)
+		}
+	}
+	// Without clans, the rosters of all the monitored clans are exported
+	if dataset == export.DatasetRoster && scope.ClanIDs == nil {
+		err = app.db.Model(&model.Clan{}).Where("tracked = ?", true).Pluck("id", &scope.ClanIDs).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	out := os.Stdout
+	if *output != "-" {
+		out, err = os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	count, err := export.Write(app.db, out, dataset, format, scope)
+	if err != nil {
+		return err
+	}
+	app.logger.Infof("exported %d rows of '%s'", count, dataset)
+	return nil
+}
+
+func cmdConfig(app *app, args []string) error {
+	if len(args) != 1 || args[0] != "check" {
+		return ErrUsage
+	}
+	err := app.cfg.ValidateDiscord()
+	if err != nil {
+		return err
+	}
+	fmt.Println("Configuration is valid")
+	return nil
+}
+
+func cmdMigrate(app *app, args []string) error {
+	db, err := storage.Open(app.cfg.DBDSN, &gorm.Config{Logger: app.glogger})
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 && args[0] == "status" {
+		version, err := storage.CurrentVersion(db)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("DB schema version: %d\n", version)
+		fmt.Printf("Supported schema version: %d\n", storage.LatestVersion())
+		pending, err := storage.PendingMigrations(db)
+		if err != nil {
+			return err
+		}
+		for _, migration := range pending {
+			fmt.Printf("Pending migration %d: %s\n", migration.Version, migration.Name)
+		}
+		return nil
+	}
+	if len(args) != 0 {
+		return ErrUsage
+	}
+	err = storage.Migrate(db, app.logger)
+	if err != nil {
+		return err
+	}
+	version, err := storage.CurrentVersion(db)
+	if err != nil {
+		return err
+	}
+	app.logger.Infof("DB schema is up to date (version %d)", version)
+	return nil
+}
+
+func cmdBackup(app *app, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	dir := flags.String("dir", app.cfg.Backup.Dir, "backup directory")
+	err := flags.Parse(args)
+	if err != nil || flags.NArg() != 0 || *dir == "" {
+		return ErrUsage
+	}
+	err = app.openDB()
+	if err != nil {
+		return err
+	}
+	keep := app.cfg.Backup.Keep
+	if keep < 1 {
+		keep = 1
+	}
+	_, err = storage.Backup(app.db, *dir, keep, app.logger)
+	return err
+}
+
+func cmdRestore(app *app, args []string) error {
+	if len(args) != 1 {
+		return ErrUsage
+	}
+	err := storage.Restore(args[0], app.cfg.DBDSN, app.logger)
+	if err != nil {
+		return err
+	}
+	app.logger.Infof("DB restored from '%s'", args[0])
+	return nil
+}
+
+func cmdNotify(app *app, args []string) error {
+	if len(args) < 1 || len(args) > 2 || args[0] != "test" {
+		return ErrUsage
+	}
+	// Only the console accepts any channel
+	channelID := "test"
+	if len(args) == 2 {
+		channelID = args[1]
+	} else if !app.cfg.Discord.DryRun {
+		return ErrUsage
+	}
+	err := app.cfg.ValidateDiscord()
+	if err != nil {
+		return err
+	}
+	err = app.openDB()
+	if err != nil {
+		return err
+	}
+	disbot, err := app.newBot(nil)
+	if err != nil {
+		return err
+	}
+	if disbot.Discord != nil {
+		defer disbot.Discord.Close()
+	}
+	_, err = disbot.Notifier.SendPlayerExitMessage(disbot.TestNotification(), channelID)
+	return err
+}
+
+func cmdUsage(app *app, args []string) error {
+	flags := flag.NewFlagSet("usage", flag.ContinueOnError)
+	days := flags.Int("days", 7, "number of days displayed, including today")
+	err := flags.Parse(args)
+	if err != nil || flags.NArg() != 0 || *days < 1 {
+		return ErrUsage
+	}
+	err = app.openDB()
+	if err != nil {
+		return err
+	}
+	since := time.Now().UTC().AddDate(0, 0, 1-*days).Format("2006-01-02")
+	usages, err := storage.APIUsageSince(app.db, since)
+	if err != nil {
+		return err
+	}
+	var jobs []string
+	totals := make(map[string]int64)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "DAY\tJOB\tAPPLICATION ID\tREQUESTS\n")
+	for _, usage := range usages {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", usage.Day, usage.Job, usage.Application, usage.Requests)
+		if _, ok := totals[usage.Job]; !ok {
+			jobs = append(jobs, usage.Job)
+		}
+		totals[usage.Job] += usage.Requests
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	// Jobs using the most requests first
+	sort.SliceStable(jobs, func(i, j int) bool { return totals[jobs[i]] > totals[jobs[j]] })
+	fmt.Printf("\nTotal since %s:\n", since)
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "JOB\tREQUESTS\n")
+	for _, job := range jobs {
+		fmt.Fprintf(w, "%s\t%d\n", job, totals[job])
+	}
+	return w.Flush()
+}
+
+func cmdPrune(app *app, args []string) error {
+	flags := flag.NewFlagSet("prune", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", app.cfg.Retention.DryRun, "only report what would be deleted")
+	err := flags.Parse(args)
+	if err != nil || flags.NArg() != 0 {
+		return ErrUsage
+	}
+	policy := app.cfg.Retention.Policy()
+	if policy == (storage.RetentionPolicy{}) {
+		app.logger.Infof("no retention configured, nothing to prune")
+		return nil
+	}
+	err = app.openDB()
+	if err != nil {
+		return err
+	}
+	report, err := storage.Prune(app.db, policy, *dryRun)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		fmt.Println("Dry-run, nothing was deleted")
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "DATA\tROWS\n")
+	for _, line := range retentionReportLines(report) {
+		fmt.Fprintf(w, "%s\t%d\n", line.name, line.rows)
+	}
+	return w.Flush()
+}
+
+type retentionLine struct {
+	name string
+	rows int64
+}
+
+func retentionReportLines(report *storage.RetentionReport) []retentionLine {
+	return []retentionLine{
+		{"notifications", report.Notifications},
+		{"notification deliveries", report.NotificationDeliveries},
+		{"follow-ups", report.FollowUps},
+		{"announcements", report.Announcements},
+		{"archived clans", report.ArchivedClans},
+		{"inactive players", report.Players},
+		{"previous clans", report.PreviousClans},
+	}
+}
+
+// logRetentionReport logs the rows pruned by the scheduled retention job
+func logRetentionReport(logger *zap.SugaredLogger, report *storage.RetentionReport, dryRun bool) {
+	verb := "pruned"
+	if dryRun {
+		verb = "would prune (dry-run)"
+	}
+	for _, line := range retentionReportLines(report) {
+		if line.rows != 0 {
+			logger.Infof("retention %s %d %s", verb, line.rows, line.name)
+		}
+	}
+}
+
+func cmdToken(app *app, args []string) error {
+	if len(args) < 1 {
+		return ErrUsage
+	}
+	err := app.openDB()
+	if err != nil {
+		return err
+	}
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		var tokens []model.APIToken
+		err = app.db.Order("discord_guild_id, id").Find(&tokens).Error
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "ID\tGUILD\tNAME\tCREATED\tLAST USED\n")
+		for _, token := range tokens {
+			lastUsed := "never"
+			if !token.LastUsedAt.IsZero() {
+				lastUsed = token.LastUsedAt.Format("2006-01-02 15:04")
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", token.ID, token.DiscordGuildID, token.Name, token.CreatedAt.Format("2006-01-02 15:04"), lastUsed)
+		}
+		return w.Flush()
+	case args[0] == "create" && len(args) == 3:
+		token, apiToken, err := storage.CreateAPIToken(app.db, args[1], args[2])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Token %d created for guild %s, it won't be displayed again:\n%s\n", apiToken.ID, apiToken.DiscordGuildID, token)
+		return nil
+	case args[0] == "revoke" && len(args) == 2:
+		id, err := strconv.ParseUint(args[1], 10, 0)
+		if err != nil {
+			return ErrUsage
+		}
+		err = storage.RevokeAPIToken(app.db, uint(id))
+		if err != nil {
+			return fmt.Errorf("token %d: %w", id, err)
+		}
+		fmt.Printf("Token %d revoked\n", id)
+		return nil
+	}
+	return ErrUsage
+}
+
+func cmdCopyDB(app *app, args []string) error {
+	if len(args) != 2 {
+		return ErrUsage
+	}
+	src, err := storage.Open(args[0], &gorm.Config{Logger: app.glogger})
+	if err != nil {
+		return err
+	}
+	dst, err := storage.Open(args[1], &gorm.Config{Logger: app.glogger})
+	if err != nil {
+		return err
+	}
+	app.logger.Infof("Copying DB content to the new backend, please wait")
+	err = storage.Copy(src, dst, app.logger)
+	if err != nil {
+		return err
+	}
+	app.logger.Infof("DB copy done")
+	return nil
+}
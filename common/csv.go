@@ -0,0 +1,42 @@
+package common
+
+import (
+	"encoding/csv"
+	"github.com/kakwa/wows-recruiting-bot/model"
+	"io"
+	"strconv"
+)
+
+// WriteClansCSV writes the list of clans in the format used for the monitored clans
+func WriteClansCSV(w io.Writer, clans []model.Clan) error {
+	csvWriter := csv.NewWriter(w)
+	for _, clan := range clans {
+		csvWriter.Write([]string{
+			clan.Tag,
+			clan.Name,
+			clan.Language,
+			clan.CreationDate.String(),
+			strconv.Itoa(clan.ID),
+		})
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+// ReadClanTagsCSV reads the clan tags from the first column of a CSV file, other columns are ignored
+func ReadClanTagsCSV(r io.Reader) ([]string, error) {
+	csvReader := csv.NewReader(r)
+	csvReader.FieldsPerRecord = -1
+	records, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var clanTags []string
+	for _, line := range records {
+		if len(line) < 1 {
+			continue
+		}
+		clanTags = append(clanTags, line[0])
+	}
+	return clanTags, nil
+}
@@ -5,6 +5,38 @@ import (
 )
 
 type PlayerExitNotification struct {
-	Player model.Player
-	Clan   model.Clan
+	// ID of the outbox entry, 0 for a test notification
+	NotificationID uint
+	Player         model.Player
+	Clan           model.Clan
+	// Clan the player is in now, nil if clanless
+	NewClan *model.Clan
+}
+
+// NewPlayerExitNotification rebuilds a player exit notification from its outbox entry
+func NewPlayerExitNotification(notification model.Notification) PlayerExitNotification {
+	clan := model.Clan{ID: notification.ClanID}
+	if notification.Clan != nil {
+		clan = *notification.Clan
+	}
+	var newClan *model.Clan
+	if notification.NewClanID != 0 {
+		newClan = &model.Clan{ID: notification.NewClanID, Tag: notification.NewClanTag}
+	}
+	return PlayerExitNotification{
+		NotificationID: notification.ID,
+		Player: model.Player{
+			ID:             notification.PlayerID,
+			Nick:           notification.Nick,
+			WinRate:        notification.WinRate,
+			Battles:        notification.Battles,
+			NumberT10:      notification.NumberT10,
+			LastBattleDate: notification.LastBattleDate,
+			HiddenProfile:  notification.HiddenProfile,
+			ClanID:         notification.NewClanID,
+			ClanTag:        notification.NewClanTag,
+		},
+		Clan:    clan,
+		NewClan: newClan,
+	}
 }
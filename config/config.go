@@ -0,0 +1,465 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kakwa/wows-recruiting-bot/backend"
+	"github.com/kakwa/wows-recruiting-bot/model"
+	"github.com/kakwa/wows-recruiting-bot/storage"
+	"github.com/pemistahl/lingua-go"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultPath = "wows-recruiting-bot.yaml"
+
+// Modes of the full scan
+const (
+	FullScanSingle  = "single"
+	FullScanRolling = "rolling"
+)
+
+type WowsConfig struct {
+	APIKey string `yaml:"api_key"`
+	// Additional application IDs, the API requests are spread over all of them
+	APIKeys     []string      `yaml:"api_keys"`
+	Realm       string        `yaml:"realm"`
+	HTTPTimeout time.Duration `yaml:"http_timeout"`
+	// Tier of the ships counted as "T10s" in filters
+	TopTier int `yaml:"top_tier"`
+	// Languages used to detect the clan languages (English names, ex: "French")
+	Languages []string `yaml:"languages"`
+	// Cache of the API responses
+	Cache CacheConfig `yaml:"cache"`
+	// Record or replay of the API traffic
+	Traffic TrafficConfig `yaml:"traffic"`
+}
+
+type CacheConfig struct {
+	Enabled    bool `yaml:"enabled"`
+	MaxEntries int  `yaml:"max_entries"`
+	// Directory where the responses are persisted between runs, the cache is only in memory if empty
+	Dir string `yaml:"dir"`
+	// Cache duration by endpoint (ex: /wows/account/info/), 0 disables the cache of the endpoint
+	TTLs map[string]time.Duration `yaml:"ttls"`
+}
+
+// Keys returns the application IDs of the pool, without duplicates
+func (wows WowsConfig) Keys() []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, key := range append([]string{wows.APIKey}, wows.APIKeys...) {
+		key = strings.TrimSpace(key)
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+type TrafficConfig struct {
+	// "live", "record" (responses saved in Dir) or "replay" (requests answered from Dir, without network access)
+	Mode string `yaml:"mode"`
+	Dir  string `yaml:"dir"`
+}
+
+type DiscordConfig struct {
+	Token string `yaml:"token"`
+	// Write the notifications to stdout as JSON lines instead of sending them, no Discord connection is made
+	DryRun bool `yaml:"dry_run"`
+}
+
+type ScanConfig struct {
+	FullScanEveryDays int    `yaml:"full_scan_every_days"`
+	FullScanAt        string `yaml:"full_scan_at"`
+	// "single": all the clans at once every FullScanEveryDays days,
+	// "rolling": every day, the daily shard of 1/FullScanEveryDays of the clans
+	FullScanMode string `yaml:"full_scan_mode"`
+	// Scan interval of the monitored clans of normal priority
+	MonitoredInterval    time.Duration `yaml:"monitored_interval"`
+	HighPriorityInterval time.Duration `yaml:"high_priority_interval"`
+	LowPriorityInterval  time.Duration `yaml:"low_priority_interval"`
+	// Budget of the monitored scan only, the other scans and checks are not counted in it
+	MaxClansPerMinute int           `yaml:"max_clans_per_minute"`
+	AnnouncedInterval time.Duration `yaml:"announced_interval"`
+	ExitGracePeriod   time.Duration `yaml:"exit_grace_period"`
+	// Scan intervals adapted to the churn of the monitored clans
+	Adaptive AdaptiveConfig `yaml:"adaptive"`
+}
+
+type AdaptiveConfig struct {
+	Enabled     bool          `yaml:"enabled"`
+	MinInterval time.Duration `yaml:"min_interval"`
+	MaxInterval time.Duration `yaml:"max_interval"`
+	// Period over which the exits of the clans are counted
+	ChurnWindowDays int `yaml:"churn_window_days"`
+}
+
+// AdaptiveIntervals returns the bounds of the adaptive scan intervals
+func (adaptive AdaptiveConfig) AdaptiveIntervals() backend.AdaptiveIntervals {
+	return backend.AdaptiveIntervals{
+		Enabled:     adaptive.Enabled,
+		MinInterval: adaptive.MinInterval,
+		MaxInterval: adaptive.MaxInterval,
+		ChurnWindow: time.Duration(adaptive.ChurnWindowDays) * 24 * time.Hour,
+	}
+}
+
+// ScanIntervals returns the scan intervals of the monitored clans by priority
+func (scan ScanConfig) ScanIntervals() map[string]time.Duration {
+	return map[string]time.Duration{
+		model.PriorityHigh:   scan.HighPriorityInterval,
+		model.PriorityNormal: scan.MonitoredInterval,
+		model.PriorityLow:    scan.LowPriorityInterval,
+	}
+}
+
+type HTTPConfig struct {
+	// Listen address of the HTTP server (metrics, health checks, REST API, dashboard), disabled if empty
+	Listen string `yaml:"listen"`
+}
+
+type BackupConfig struct {
+	// Directory of the SQLite DB backups, backups are disabled if empty
+	Dir      string        `yaml:"dir"`
+	Interval time.Duration `yaml:"interval"`
+	// Number of backups kept
+	Keep int `yaml:"keep"`
+}
+
+type RetentionConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	// Only log what would be pruned
+	DryRun bool `yaml:"dry_run"`
+	// Ages in days after which the data is pruned, 0 keeps the data forever
+	SnapshotsDays       int `yaml:"snapshots_days"`
+	ArchiveClansDays    int `yaml:"archive_clans_days"`
+	InactivePlayersDays int `yaml:"inactive_players_days"`
+	PreviousClansDays   int `yaml:"previous_clans_days"`
+}
+
+// Policy returns the retention policy, it's empty if nothing is pruned
+func (retention RetentionConfig) Policy() storage.RetentionPolicy {
+	day := 24 * time.Hour
+	return storage.RetentionPolicy{
+		SnapshotsAge:       time.Duration(retention.SnapshotsDays) * day,
+		ArchiveClansAge:    time.Duration(retention.ArchiveClansDays) * day,
+		InactivePlayersAge: time.Duration(retention.InactivePlayersDays) * day,
+		PreviousClansAge:   time.Duration(retention.PreviousClansDays) * day,
+	}
+}
+
+type Config struct {
+	Debug   bool          `yaml:"debug"`
+	DBDSN   string        `yaml:"db_dsn"`
+	Wows    WowsConfig    `yaml:"wows"`
+	Discord DiscordConfig `yaml:"discord"`
+	Scan    ScanConfig    `yaml:"scan"`
+	HTTP    HTTPConfig    `yaml:"http"`
+	Backup  BackupConfig  `yaml:"backup"`
+	// Retention of the old data
+	Retention RetentionConfig `yaml:"retention"`
+}
+
+// ValidationError lists all the problems found in the configuration
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n * " + strings.Join(e.Problems, "\n * ")
+}
+
+// Default returns the configuration used for the settings not set in the file or the environment
+func Default() *Config {
+	var languages []string
+	for _, language := range backend.DefaultLanguages {
+		languages = append(languages, language.String())
+	}
+	// Copied, the TTLs set in the file are merged in it
+	ttls := make(map[string]time.Duration, len(backend.DefaultCacheTTLs))
+	for endpoint, ttl := range backend.DefaultCacheTTLs {
+		ttls[endpoint] = ttl
+	}
+	return &Config{
+		DBDSN: storage.DefaultDSN,
+		Wows: WowsConfig{
+			Realm:       "eu",
+			HTTPTimeout: 10 * time.Second,
+			TopTier:     10,
+			Languages:   languages,
+			Cache: CacheConfig{
+				Enabled:    true,
+				MaxEntries: 20000,
+				TTLs:       ttls,
+			},
+			Traffic: TrafficConfig{
+				Mode: backend.TrafficLive,
+			},
+		},
+		Scan: ScanConfig{
+			FullScanEveryDays:    7,
+			FullScanAt:           "10:30",
+			FullScanMode:         FullScanSingle,
+			MonitoredInterval:    2 * time.Hour,
+			HighPriorityInterval: 15 * time.Minute,
+			LowPriorityInterval:  24 * time.Hour,
+			MaxClansPerMinute:    100,
+			Adaptive: AdaptiveConfig{
+				Enabled:         backend.DefaultAdaptiveIntervals.Enabled,
+				MinInterval:     backend.DefaultAdaptiveIntervals.MinInterval,
+				MaxInterval:     backend.DefaultAdaptiveIntervals.MaxInterval,
+				ChurnWindowDays: 30,
+			},
+			AnnouncedInterval: 6 * time.Hour,
+		},
+		Backup: BackupConfig{
+			Interval: 24 * time.Hour,
+			Keep:     7,
+		},
+		Retention: RetentionConfig{
+			Interval: 24 * time.Hour,
+		},
+	}
+}
+
+// Load reads the configuration file and applies the environment overrides, the result must be checked with Validate.
+// A missing file is only an error if required is set, the configuration then comes from the environment.
+func Load(path string, required bool) (*Config, error) {
+	config := Default()
+	file, err := os.Open(path)
+	switch {
+	case err == nil:
+		defer file.Close()
+		decoder := yaml.NewDecoder(file)
+		decoder.KnownFields(true)
+		err = decoder.Decode(config)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("failed to parse '%s': %w", path, err)
+		}
+	case errors.Is(err, os.ErrNotExist) && !required:
+	default:
+		return nil, err
+	}
+
+	err = config.applyEnv()
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// applyEnv overrides the configuration with the WOWS_* environment variables
+func (config *Config) applyEnv() error {
+	problems := []string{}
+	if value, ok := os.LookupEnv("WOWS_WOWSAPIKEY"); ok {
+		// Comma separated list of application IDs
+		keys := strings.Split(value, ",")
+		config.Wows.APIKey = keys[0]
+		config.Wows.APIKeys = keys[1:]
+	}
+	if value, ok := os.LookupEnv("WOWS_REALM"); ok {
+		config.Wows.Realm = value
+	}
+	if value, ok := os.LookupEnv("WOWS_DISCORD_TOKEN"); ok {
+		config.Discord.Token = value
+	}
+	if value, ok := os.LookupEnv("WOWS_DB_DSN"); ok {
+		config.DBDSN = value
+	}
+	if value, ok := os.LookupEnv("WOWS_HTTP_LISTEN"); ok {
+		config.HTTP.Listen = value
+	}
+	if value, ok := os.LookupEnv("WOWS_BACKUP_DIR"); ok {
+		config.Backup.Dir = value
+	}
+	if value, ok := os.LookupEnv("WOWS_DEBUG"); ok {
+		// Any other value than "true" disables the debug logs, as before the configuration file
+		config.Debug = value == "true"
+	}
+	if value, ok := os.LookupEnv("WOWS_DRY_RUN"); ok {
+		dryRun, err := strconv.ParseBool(value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("WOWS_DRY_RUN: '%s' is not a boolean", value))
+		}
+		config.Discord.DryRun = dryRun
+	}
+	if value, ok := os.LookupEnv("WOWS_EXIT_GRACE_PERIOD"); ok {
+		gracePeriod, err := time.ParseDuration(value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("WOWS_EXIT_GRACE_PERIOD: '%s' is not a duration (ex: 4h)", value))
+		}
+		config.Scan.ExitGracePeriod = gracePeriod
+	}
+	if len(problems) != 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// Validate checks the configuration and reports all the problems found,
+// the Discord settings are checked separately as they are only needed to run the bot
+func (config *Config) Validate() error {
+	problems := []string{}
+	// A replay is done without the API
+	if len(config.Wows.Keys()) == 0 && config.Wows.Traffic.Mode != backend.TrafficReplay {
+		problems = append(problems, "wows.api_key (WOWS_WOWSAPIKEY) is not set")
+	}
+	switch config.Wows.Traffic.Mode {
+	case backend.TrafficLive:
+	case backend.TrafficRecord, backend.TrafficReplay:
+		if config.Wows.Traffic.Dir == "" {
+			problems = append(problems, fmt.Sprintf("wows.traffic.dir must be set to %s the API traffic", config.Wows.Traffic.Mode))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("wows.traffic.mode: unknown mode '%s', expected 'live', 'record' or 'replay'", config.Wows.Traffic.Mode))
+	}
+	if _, err := backend.WowsRealm(config.Wows.Realm); err != nil {
+		problems = append(problems, fmt.Sprintf("wows.realm (WOWS_REALM): unknown realm '%s', expected 'eu', 'na' or 'asia'", config.Wows.Realm))
+	}
+	if config.Wows.HTTPTimeout <= 0 {
+		problems = append(problems, "wows.http_timeout must be positive")
+	}
+	if config.Wows.TopTier < 1 || config.Wows.TopTier > 11 {
+		problems = append(problems, fmt.Sprintf("wows.top_tier: %d is not a valid ship tier", config.Wows.TopTier))
+	}
+	if len(config.Wows.Languages) == 0 {
+		problems = append(problems, "wows.languages must contain at least one language")
+	}
+	for _, name := range config.Wows.Languages {
+		if _, ok := languageFromName(name); !ok {
+			problems = append(problems, fmt.Sprintf("wows.languages: unknown language '%s'", name))
+		}
+	}
+	if config.Wows.Cache.Enabled {
+		if config.Wows.Cache.MaxEntries < 1 {
+			problems = append(problems, "wows.cache.max_entries must be at least 1")
+		}
+		var endpoints []string
+		for endpoint := range config.Wows.Cache.TTLs {
+			endpoints = append(endpoints, endpoint)
+		}
+		sort.Strings(endpoints)
+		for _, endpoint := range endpoints {
+			if !strings.HasPrefix(endpoint, "/") {
+				problems = append(problems, fmt.Sprintf("wows.cache.ttls: '%s' is not an endpoint path (ex: /wows/account/info/)", endpoint))
+			}
+			if config.Wows.Cache.TTLs[endpoint] < 0 {
+				problems = append(problems, fmt.Sprintf("wows.cache.ttls: the TTL of '%s' must not be negative", endpoint))
+			}
+		}
+	}
+	if _, err := storage.Dialector(config.DBDSN); err != nil {
+		problems = append(problems, fmt.Sprintf("db_dsn (WOWS_DB_DSN): %s", err.Error()))
+	}
+	if config.Scan.FullScanEveryDays < 1 {
+		problems = append(problems, "scan.full_scan_every_days must be at least 1")
+	}
+	if config.Scan.FullScanMode != FullScanSingle && config.Scan.FullScanMode != FullScanRolling {
+		problems = append(problems, fmt.Sprintf("scan.full_scan_mode: unknown mode '%s', expected 'single' or 'rolling'", config.Scan.FullScanMode))
+	}
+	if _, err := time.Parse("15:04", config.Scan.FullScanAt); err != nil {
+		problems = append(problems, fmt.Sprintf("scan.full_scan_at: '%s' is not a time of day (ex: 10:30)", config.Scan.FullScanAt))
+	}
+	if config.Scan.MonitoredInterval < time.Minute {
+		problems = append(problems, "scan.monitored_interval must be at least 1m")
+	}
+	if config.Scan.HighPriorityInterval < time.Minute {
+		problems = append(problems, "scan.high_priority_interval must be at least 1m")
+	}
+	if config.Scan.LowPriorityInterval < time.Minute {
+		problems = append(problems, "scan.low_priority_interval must be at least 1m")
+	}
+	if config.Scan.MaxClansPerMinute < 1 {
+		problems = append(problems, "scan.max_clans_per_minute must be at least 1")
+	}
+	if config.Scan.Adaptive.Enabled {
+		if config.Scan.Adaptive.MinInterval < time.Minute {
+			problems = append(problems, "scan.adaptive.min_interval must be at least 1m")
+		}
+		if config.Scan.Adaptive.MaxInterval < config.Scan.Adaptive.MinInterval {
+			problems = append(problems, "scan.adaptive.max_interval must be greater than scan.adaptive.min_interval")
+		}
+		if config.Scan.Adaptive.ChurnWindowDays < 1 {
+			problems = append(problems, "scan.adaptive.churn_window_days must be at least 1")
+		}
+	}
+	if config.Scan.AnnouncedInterval < time.Minute {
+		problems = append(problems, "scan.announced_interval must be at least 1m")
+	}
+	if config.Scan.ExitGracePeriod < 0 {
+		problems = append(problems, "scan.exit_grace_period (WOWS_EXIT_GRACE_PERIOD) can't be negative")
+	}
+	if config.Backup.Dir != "" {
+		if _, ok := storage.SQLitePath(config.DBDSN); !ok {
+			problems = append(problems, "backup.dir (WOWS_BACKUP_DIR): backups are only supported on SQLite DBs")
+		}
+		if config.Backup.Interval < time.Minute {
+			problems = append(problems, "backup.interval must be at least 1m")
+		}
+		if config.Backup.Keep < 1 {
+			problems = append(problems, "backup.keep must be at least 1")
+		}
+	}
+	if config.Retention.Policy() != (storage.RetentionPolicy{}) && config.Retention.Interval < time.Minute {
+		problems = append(problems, "retention.interval must be at least 1m")
+	}
+	for _, retention := range []struct {
+		name string
+		days int
+	}{
+		{"snapshots_days", config.Retention.SnapshotsDays},
+		{"archive_clans_days", config.Retention.ArchiveClansDays},
+		{"inactive_players_days", config.Retention.InactivePlayersDays},
+		{"previous_clans_days", config.Retention.PreviousClansDays},
+	} {
+		if retention.days < 0 {
+			problems = append(problems, fmt.Sprintf("retention.%s can't be negative", retention.name))
+		}
+	}
+	if config.HTTP.Listen != "" {
+		if _, _, err := net.SplitHostPort(config.HTTP.Listen); err != nil {
+			problems = append(problems, fmt.Sprintf("http.listen (WOWS_HTTP_LISTEN): '%s' is not a listen address (ex: :8080)", config.HTTP.Listen))
+		}
+	}
+	if len(problems) != 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// ValidateDiscord checks the settings needed to connect to Discord, nothing is needed in dry-run
+func (config *Config) ValidateDiscord() error {
+	if config.Discord.Token == "" && !config.Discord.DryRun {
+		return &ValidationError{Problems: []string{"discord.token (WOWS_DISCORD_TOKEN) is not set"}}
+	}
+	return nil
+}
+
+func languageFromName(name string) (lingua.Language, bool) {
+	for _, language := range lingua.AllLanguages() {
+		if strings.EqualFold(language.String(), name) {
+			return language, true
+		}
+	}
+	return lingua.Unknown, false
+}
+
+// DetectionLanguages returns the languages used to detect the clan languages
+func (config *Config) DetectionLanguages() []lingua.Language {
+	var languages []lingua.Language
+	for _, name := range config.Wows.Languages {
+		if language, ok := languageFromName(name); ok {
+			languages = append(languages, language)
+		}
+	}
+	return languages
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"errors"
+	"github.com/kakwa/wows-recruiting-bot/backend"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		update   func(config *Config)
+		problems []string
+	}{
+		{name: "default", update: func(config *Config) {}},
+		{name: "no API key", update: func(config *Config) { config.Wows.APIKey = "" },
+			problems: []string{"wows.api_key (WOWS_WOWSAPIKEY) is not set"}},
+		{name: "replay without API key", update: func(config *Config) {
+			config.Wows.APIKey = ""
+			config.Wows.Traffic = TrafficConfig{Mode: backend.TrafficReplay, Dir: "traffic"}
+		}},
+		{name: "record without dir", update: func(config *Config) { config.Wows.Traffic.Mode = backend.TrafficRecord },
+			problems: []string{"wows.traffic.dir must be set to record the API traffic"}},
+		{name: "unknown traffic mode", update: func(config *Config) { config.Wows.Traffic.Mode = "proxy" },
+			problems: []string{"wows.traffic.mode: unknown mode 'proxy', expected 'live', 'record' or 'replay'"}},
+		{name: "unknown realm", update: func(config *Config) { config.Wows.Realm = "ru" },
+			problems: []string{"wows.realm (WOWS_REALM): unknown realm 'ru', expected 'eu', 'na' or 'asia'"}},
+		{name: "no cache entries", update: func(config *Config) { config.Wows.Cache.MaxEntries = 0 },
+			problems: []string{"wows.cache.max_entries must be at least 1"}},
+		{name: "disabled cache", update: func(config *Config) {
+			config.Wows.Cache.Enabled = false
+			config.Wows.Cache.MaxEntries = 0
+		}},
+		{name: "bad TTL endpoint", update: func(config *Config) { config.Wows.Cache.TTLs["wows/clans/info/"] = time.Hour },
+			problems: []string{"wows.cache.ttls: 'wows/clans/info/' is not an endpoint path (ex: /wows/account/info/)"}},
+		{name: "bad full scan time", update: func(config *Config) { config.Scan.FullScanAt = "25:00" },
+			problems: []string{"scan.full_scan_at: '25:00' is not a time of day (ex: 10:30)"}},
+		{name: "no clan budget", update: func(config *Config) { config.Scan.MaxClansPerMinute = 0 },
+			problems: []string{"scan.max_clans_per_minute must be at least 1"}},
+		{name: "adaptive max below min", update: func(config *Config) {
+			config.Scan.Adaptive.Enabled = true
+			config.Scan.Adaptive.MaxInterval = time.Minute
+		}, problems: []string{"scan.adaptive.max_interval must be greater than scan.adaptive.min_interval"}},
+		{name: "disabled adaptive", update: func(config *Config) { config.Scan.Adaptive.MaxInterval = time.Minute }},
+		{name: "negative grace period", update: func(config *Config) { config.Scan.ExitGracePeriod = -time.Hour },
+			problems: []string{"scan.exit_grace_period (WOWS_EXIT_GRACE_PERIOD) can't be negative"}},
+		{name: "negative retention", update: func(config *Config) { config.Retention.SnapshotsDays = -1 },
+			problems: []string{"retention.snapshots_days can't be negative"}},
+		{name: "several problems", update: func(config *Config) {
+			config.Wows.APIKey = ""
+			config.Scan.MaxClansPerMinute = 0
+		}, problems: []string{"wows.api_key (WOWS_WOWSAPIKEY) is not set", "scan.max_clans_per_minute must be at least 1"}},
+	}
+	for _, test := range tests {
+		config := Default()
+		config.Wows.APIKey = "key"
+		test.update(config)
+		err := config.Validate()
+		if test.problems == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", test.name, err.Error())
+			}
+			continue
+		}
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) {
+			t.Errorf("%s: expected a validation error, got %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(validationErr.Problems, test.problems) {
+			t.Errorf("%s: problems = %q, expected %q", test.name, validationErr.Problems, test.problems)
+		}
+	}
+}
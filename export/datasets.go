@@ -0,0 +1,242 @@
+package export
+
+import (
+	"errors"
+	"github.com/kakwa/wows-recruiting-bot/common"
+	"github.com/kakwa/wows-recruiting-bot/model"
+	"github.com/kakwa/wows-recruiting-bot/storage"
+	"gorm.io/gorm"
+	"io"
+	"strings"
+	"time"
+)
+
+type Dataset string
+
+const (
+	DatasetPlayers       Dataset = "players"
+	DatasetPreviousClans Dataset = "previous-clans"
+	DatasetExits         Dataset = "exits"
+	DatasetRoster        Dataset = "roster"
+	DatasetTrackedClans  Dataset = "tracked-clans"
+	DatasetNotifications Dataset = "notifications"
+)
+
+var Datasets = []Dataset{DatasetPlayers, DatasetPreviousClans, DatasetExits, DatasetRoster, DatasetTrackedClans, DatasetNotifications}
+
+var ErrUnknownDataset = errors.New("Unknown export dataset")
+
+// Rows are read and written in batches of this size
+const batchSize = 1000
+
+func ParseDataset(name string) (Dataset, error) {
+	for _, dataset := range Datasets {
+		if string(dataset) == strings.ToLower(name) {
+			return dataset, nil
+		}
+	}
+	return "", ErrUnknownDataset
+}
+
+// Scope restricts the exported rows, unset fields don't restrict anything
+type Scope struct {
+	// Exits matched by the filter of this Discord channel
+	DiscordChannelID string
+	// Players of these clans (roster, required), exits from these clans (previous-clans)
+	ClanIDs []int
+}
+
+// ChannelScope restricts the export to the filter of a Discord channel and its monitored clans
+func ChannelScope(db *gorm.DB, discordChannelID string) (Scope, error) {
+	filter, err := storage.GetFilter(db, discordChannelID)
+	if err != nil {
+		return Scope{}, err
+	}
+	scope := Scope{DiscordChannelID: discordChannelID, ClanIDs: []int{}}
+	for _, clan := range filter.TrackedClans {
+		scope.ClanIDs = append(scope.ClanIDs, clan.ID)
+	}
+	return scope, nil
+}
+
+type PlayerRow struct {
+	ID                  int       `json:"id" parquet:"id"`
+	Nick                string    `json:"nick" parquet:"nick"`
+	ClanID              int       `json:"clan_id" parquet:"clan_id"`
+	ClanTag             string    `json:"clan_tag" parquet:"clan_tag"`
+	ClanJoinDate        time.Time `json:"clan_join_date" parquet:"clan_join_date"`
+	WinRate             float64   `json:"win_rate" parquet:"win_rate"`
+	Battles             int       `json:"battles" parquet:"battles"`
+	NumberT10           int       `json:"number_t10" parquet:"number_t10"`
+	HiddenProfile       bool      `json:"hidden_profile" parquet:"hidden_profile"`
+	AccountCreationDate time.Time `json:"account_creation_date" parquet:"account_creation_date"`
+	LastBattleDate      time.Time `json:"last_battle_date" parquet:"last_battle_date"`
+	LastLogoutDate      time.Time `json:"last_logout_date" parquet:"last_logout_date"`
+	UpdatedAt           time.Time `json:"updated_at" parquet:"updated_at"`
+}
+
+type PreviousClanRow struct {
+	PlayerID  int       `json:"player_id" parquet:"player_id"`
+	Nick      string    `json:"nick" parquet:"nick"`
+	ClanID    int       `json:"clan_id" parquet:"clan_id"`
+	ClanTag   string    `json:"clan_tag" parquet:"clan_tag"`
+	JoinDate  time.Time `json:"join_date" parquet:"join_date"`
+	LeaveDate time.Time `json:"leave_date" parquet:"leave_date"`
+}
+
+type ExitRow struct {
+	DiscordChannelID string    `json:"channel_id" parquet:"channel_id"`
+	Status           string    `json:"status" parquet:"status"`
+	DetectedAt       time.Time `json:"detected_at" parquet:"detected_at"`
+	SentAt           time.Time `json:"sent_at" parquet:"sent_at"`
+	PlayerID         int       `json:"player_id" parquet:"player_id"`
+	Nick             string    `json:"nick" parquet:"nick"`
+	WinRate          float64   `json:"win_rate" parquet:"win_rate"`
+	Battles          int       `json:"battles" parquet:"battles"`
+	NumberT10        int       `json:"number_t10" parquet:"number_t10"`
+	LastBattleDate   time.Time `json:"last_battle_date" parquet:"last_battle_date"`
+	HiddenProfile    bool      `json:"hidden_profile" parquet:"hidden_profile"`
+	ClanID           int       `json:"clan_id" parquet:"clan_id"`
+	ClanTag          string    `json:"clan_tag" parquet:"clan_tag"`
+	NewClanID        int       `json:"new_clan_id" parquet:"new_clan_id"`
+	NewClanTag       string    `json:"new_clan_tag" parquet:"new_clan_tag"`
+}
+
+// NotificationRow is an exit of the notification outbox, without its detection date
+// so the exits detected from a replayed API traffic are always exported the same
+type NotificationRow struct {
+	Status         string    `json:"status" parquet:"status"`
+	PlayerID       int       `json:"player_id" parquet:"player_id"`
+	Nick           string    `json:"nick" parquet:"nick"`
+	WinRate        float64   `json:"win_rate" parquet:"win_rate"`
+	Battles        int       `json:"battles" parquet:"battles"`
+	NumberT10      int       `json:"number_t10" parquet:"number_t10"`
+	LastBattleDate time.Time `json:"last_battle_date" parquet:"last_battle_date"`
+	HiddenProfile  bool      `json:"hidden_profile" parquet:"hidden_profile"`
+	ClanID         int       `json:"clan_id" parquet:"clan_id"`
+	ClanTag        string    `json:"clan_tag" parquet:"clan_tag"`
+	NewClanID      int       `json:"new_clan_id" parquet:"new_clan_id"`
+	NewClanTag     string    `json:"new_clan_tag" parquet:"new_clan_tag"`
+}
+
+type ClanRow struct {
+	Tag          string    `json:"tag" parquet:"tag"`
+	Name         string    `json:"name" parquet:"name"`
+	Language     string    `json:"language" parquet:"language"`
+	CreationDate time.Time `json:"creation_date" parquet:"creation_date"`
+	ID           int       `json:"id" parquet:"id"`
+}
+
+// Write exports a dataset to w, it returns the number of exported rows
+func Write(db *gorm.DB, w io.Writer, dataset Dataset, format Format, scope Scope) (int, error) {
+	switch dataset {
+	case DatasetPlayers:
+		return writeQuery[PlayerRow](db, playersQuery(db), w, format)
+	case DatasetRoster:
+		return writeQuery[PlayerRow](db, playersQuery(db).Where("players.clan_id IN ?", scope.ClanIDs), w, format)
+	case DatasetPreviousClans:
+		query := db.Table("previous_clans").
+			Select("previous_clans.player_id, players.nick, previous_clans.clan_id, clans.tag AS clan_tag, previous_clans.join_date, previous_clans.leave_date").
+			Joins("LEFT JOIN players ON players.id = previous_clans.player_id").
+			Joins("LEFT JOIN clans ON clans.id = previous_clans.clan_id").
+			Where("previous_clans.deleted_at IS NULL").
+			Order("previous_clans.leave_date, previous_clans.id")
+		if scope.ClanIDs != nil {
+			query = query.Where("previous_clans.clan_id IN ?", scope.ClanIDs)
+		}
+		return writeQuery[PreviousClanRow](db, query, w, format)
+	case DatasetExits:
+		query := db.Table("notification_deliveries").
+			Select("notification_deliveries.discord_channel_id, notification_deliveries.status, notifications.created_at AS detected_at, notification_deliveries.sent_at, " +
+				"notifications.player_id, notifications.nick, notifications.win_rate, notifications.battles, notifications.number_t10, notifications.last_battle_date, notifications.hidden_profile, " +
+				"notifications.clan_id, clans.tag AS clan_tag, notifications.new_clan_id, notifications.new_clan_tag").
+			Joins("JOIN notifications ON notifications.id = notification_deliveries.notification_id").
+			Joins("LEFT JOIN clans ON clans.id = notifications.clan_id").
+			Where("notification_deliveries.deleted_at IS NULL").
+			Order("notifications.created_at, notification_deliveries.id")
+		if scope.DiscordChannelID != "" {
+			query = query.Where("notification_deliveries.discord_channel_id = ?", scope.DiscordChannelID)
+		}
+		return writeQuery[ExitRow](db, query, w, format)
+	case DatasetNotifications:
+		query := db.Table("notifications").
+			Select("notifications.status, notifications.player_id, notifications.nick, notifications.win_rate, notifications.battles, notifications.number_t10, " +
+				"notifications.last_battle_date, notifications.hidden_profile, notifications.clan_id, clans.tag AS clan_tag, notifications.new_clan_id, notifications.new_clan_tag").
+			Joins("LEFT JOIN clans ON clans.id = notifications.clan_id").
+			Where("notifications.deleted_at IS NULL").
+			Order("notifications.clan_id, notifications.player_id, notifications.id")
+		if scope.ClanIDs != nil {
+			query = query.Where("notifications.clan_id IN ?", scope.ClanIDs)
+		}
+		return writeQuery[NotificationRow](db, query, w, format)
+	case DatasetTrackedClans:
+		if format == FormatCSV {
+			// Kept in the format of the monitored clans imports
+			var clans []model.Clan
+			query := db.Where("tracked = ?", true).Order("tag")
+			if scope.ClanIDs != nil {
+				query = query.Where("id IN ?", scope.ClanIDs)
+			}
+			err := query.Find(&clans).Error
+			if err != nil {
+				return 0, err
+			}
+			return len(clans), common.WriteClansCSV(w, clans)
+		}
+		query := db.Model(&model.Clan{}).Select("tag, name, language, creation_date, id").Where("tracked = ?", true).Order("tag")
+		if scope.ClanIDs != nil {
+			query = query.Where("id IN ?", scope.ClanIDs)
+		}
+		return writeQuery[ClanRow](db, query, w, format)
+	}
+	return 0, ErrUnknownDataset
+}
+
+func playersQuery(db *gorm.DB) *gorm.DB {
+	return db.Table("players").
+		Select("players.*, clans.tag AS clan_tag").
+		Joins("LEFT JOIN clans ON clans.id = players.clan_id").
+		Where("players.deleted_at IS NULL").
+		Order("players.id")
+}
+
+// writeQuery streams the rows of the query to the writer
+func writeQuery[T any](db *gorm.DB, query *gorm.DB, w io.Writer, format Format) (int, error) {
+	writer, err := newRowWriter[T](w, format)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := query.Rows()
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	count := 0
+	batch := make([]T, 0, batchSize)
+	for rows.Next() {
+		var row T
+		err = db.ScanRows(rows, &row)
+		if err != nil {
+			return count, err
+		}
+		batch = append(batch, row)
+		if len(batch) == batchSize {
+			err = writer.Write(batch)
+			if err != nil {
+				return count, err
+			}
+			count += len(batch)
+			batch = batch[:0]
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return count, err
+	}
+	err = writer.Write(batch)
+	if err != nil {
+		return count, err
+	}
+	count += len(batch)
+	return count, writer.Close()
+}
@@ -0,0 +1,212 @@
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/xitongsys/parquet-go/parquet"
+	parquetwriter "github.com/xitongsys/parquet-go/writer"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Format string
+
+const (
+	FormatCSV     Format = "csv"
+	FormatJSONL   Format = "jsonl"
+	FormatParquet Format = "parquet"
+)
+
+var Formats = []Format{FormatCSV, FormatJSONL, FormatParquet}
+
+var ErrUnknownFormat = errors.New("Unknown export format, expected 'csv', 'jsonl' or 'parquet'")
+
+func ParseFormat(name string) (Format, error) {
+	for _, format := range Formats {
+		if string(format) == strings.ToLower(name) {
+			return format, nil
+		}
+	}
+	return "", ErrUnknownFormat
+}
+
+// ContentType returns the MIME type of the format
+func (format Format) ContentType() string {
+	switch format {
+	case FormatCSV:
+		return "text/csv"
+	case FormatJSONL:
+		return "application/jsonl"
+	}
+	return "application/vnd.apache.parquet"
+}
+
+// rowWriter writes rows in batches, Close must be called to complete the output
+type rowWriter[T any] interface {
+	Write(rows []T) error
+	Close() error
+}
+
+func newRowWriter[T any](w io.Writer, format Format) (rowWriter[T], error) {
+	switch format {
+	case FormatCSV:
+		return newCSVWriter[T](w)
+	case FormatJSONL:
+		return &jsonlWriter[T]{encoder: json.NewEncoder(w)}, nil
+	case FormatParquet:
+		return newParquetWriter[T](w)
+	}
+	return nil, ErrUnknownFormat
+}
+
+type jsonlWriter[T any] struct {
+	encoder *json.Encoder
+}
+
+func (writer *jsonlWriter[T]) Write(rows []T) error {
+	for _, row := range rows {
+		err := writer.encoder.Encode(row)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (writer *jsonlWriter[T]) Close() error {
+	return nil
+}
+
+// parquetWriter writes the fields of the rows in order, the schema is made of their json names and types
+type parquetWriter[T any] struct {
+	writer *parquetwriter.CSVWriter
+}
+
+func newParquetWriter[T any](w io.Writer) (*parquetWriter[T], error) {
+	rowType := reflect.TypeOf(new(T)).Elem()
+	metadata := make([]string, rowType.NumField())
+	for i := range metadata {
+		field := rowType.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		var parquetType string
+		repetition := "REQUIRED"
+		switch field.Type {
+		case reflect.TypeOf(""):
+			parquetType = "type=BYTE_ARRAY, convertedtype=UTF8"
+		case reflect.TypeOf(0), reflect.TypeOf(uint(0)):
+			parquetType = "type=INT64"
+		case reflect.TypeOf(0.0):
+			parquetType = "type=DOUBLE"
+		case reflect.TypeOf(false):
+			parquetType = "type=BOOLEAN"
+		case reflect.TypeOf(time.Time{}):
+			// Unset dates are null
+			parquetType = "type=INT64, convertedtype=TIMESTAMP_MILLIS"
+			repetition = "OPTIONAL"
+		default:
+			return nil, fmt.Errorf("unsupported type %s for parquet column '%s'", field.Type, name)
+		}
+		metadata[i] = fmt.Sprintf("name=%s, %s, repetitiontype=%s", name, parquetType, repetition)
+	}
+	writer, err := parquetwriter.NewCSVWriterFromWriter(metadata, w, 1)
+	if err != nil {
+		return nil, err
+	}
+	writer.CompressionType = parquet.CompressionCodec_SNAPPY
+	return &parquetWriter[T]{writer: writer}, nil
+}
+
+func (writer *parquetWriter[T]) Write(rows []T) error {
+	for _, row := range rows {
+		value := reflect.ValueOf(row)
+		record := make([]interface{}, value.NumField())
+		for i := range record {
+			record[i] = parquetValue(value.Field(i).Interface())
+		}
+		err := writer.writer.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (writer *parquetWriter[T]) Close() error {
+	return writer.writer.WriteStop()
+}
+
+func parquetValue(value any) any {
+	switch v := value.(type) {
+	case int:
+		return int64(v)
+	case uint:
+		return int64(v)
+	case time.Time:
+		if v.IsZero() {
+			return nil
+		}
+		return v.UnixMilli()
+	}
+	return value
+}
+
+// csvWriter writes the fields of the rows in order, the header is made of their json names
+type csvWriter[T any] struct {
+	writer *csv.Writer
+}
+
+func newCSVWriter[T any](w io.Writer) (*csvWriter[T], error) {
+	writer := &csvWriter[T]{writer: csv.NewWriter(w)}
+	rowType := reflect.TypeOf(new(T)).Elem()
+	header := make([]string, rowType.NumField())
+	for i := range header {
+		header[i], _, _ = strings.Cut(rowType.Field(i).Tag.Get("json"), ",")
+	}
+	return writer, writer.writer.Write(header)
+}
+
+func (writer *csvWriter[T]) Write(rows []T) error {
+	for _, row := range rows {
+		value := reflect.ValueOf(row)
+		record := make([]string, value.NumField())
+		for i := range record {
+			record[i] = csvValue(value.Field(i).Interface())
+		}
+		err := writer.writer.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (writer *csvWriter[T]) Close() error {
+	writer.writer.Flush()
+	return writer.writer.Error()
+}
+
+func csvValue(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case int:
+		return strconv.Itoa(v)
+	case uint:
+		return strconv.FormatUint(uint64(v), 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Time:
+		if v.IsZero() {
+			return ""
+		}
+		return v.UTC().Format(time.RFC3339)
+	}
+	return fmt.Sprint(value)
+}
@@ -1,19 +1,21 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/go-co-op/gocron"
-	"github.com/kakwa/wows-recruiting-bot/backend"
-	"github.com/kakwa/wows-recruiting-bot/bot"
-	"github.com/kakwa/wows-recruiting-bot/common"
-	"github.com/kakwa/wows-recruiting-bot/model"
+	"github.com/kakwa/wows-recruiting-bot/config"
+	"github.com/kakwa/wows-recruiting-bot/metrics"
+	"github.com/kakwa/wows-recruiting-bot/storage"
+	"github.com/kakwa/wows-recruiting-bot/web"
 	"go.uber.org/zap"
 	"golang.org/x/exp/constraints"
-	"gorm.io/driver/sqlite"
-	"gorm.io/gorm"
 	"moul.io/zapgorm2"
 	"os"
 	"os/signal"
+	"sort"
 	"sync"
 	"syscall"
 	"time"
@@ -26,77 +28,208 @@ func min[T constraints.Ordered](a, b T) T {
 	return b
 }
 
-func main() {
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [-config <file>] [command]\n\nCommands:\n", os.Args[0])
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-60s %s\n", commands[name].usage, commands[name].description)
+	}
+	fmt.Fprintf(out, "\nOptions:\n")
+	flag.PrintDefaults()
+}
 
-	key := os.Getenv("WOWS_WOWSAPIKEY")
-	server := os.Getenv("WOWS_REALM")
-	debug := os.Getenv("WOWS_DEBUG")
-	botToken := os.Getenv("WOWS_DISCORD_TOKEN")
+func serve(app *app) error {
+	mainLogger := app.logger.With("component", "main")
+	cfg := app.cfg
+	db := app.db
+	api := app.backend
 
-	var loggerConfig zap.Config
-	if debug == "true" {
-		loggerConfig = zap.NewDevelopmentConfig()
-	} else {
-		loggerConfig = zap.NewProductionConfig()
-	}
+	botChanOSSig := make(chan os.Signal, 1)
 
-	logger, err := loggerConfig.Build()
-	if err != nil {
-		fmt.Printf("Error initializing logger: %s\n", err.Error())
-		os.Exit(-1)
+	var server *web.Server
+	if cfg.HTTP.Listen != "" {
+		metrics.RegisterDB(app.ctx, db)
+		server = web.NewServer(cfg.HTTP.Listen, app.logger.With("component", "web"), db, api, cfg.Scan.MonitoredInterval)
+		server.Start()
+	}
+	shutdownServer := func() {
+		if server == nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
 	}
-	defer logger.Sync()
-	glogger := zapgorm2.New(logger)
-	sugar := logger.Sugar()
-	mainLogger := sugar.With("component", "main")
 
-	db, err := gorm.Open(sqlite.Open("wows-recruiting-bot.db"), &gorm.Config{Logger: glogger})
+	// Connected before the scans, so they don't run for nothing if Discord is unreachable
+	disbot, err := app.newBot(botChanOSSig)
 	if err != nil {
-		panic("failed to connect database")
+		shutdownServer()
+		return err
 	}
-
-	Schemas := []interface{}{
-		&model.Player{},
-		&model.PreviousClan{},
-		&model.Clan{},
-		&model.Filter{},
+	if server != nil {
+		server.SetBot(disbot)
 	}
 
-	// Migrate the schema
-	db.AutoMigrate(Schemas...)
-
-	ch := make(chan common.PlayerExitNotification, 10)
-	botChanOSSig := make(chan os.Signal, 1)
-	api := backend.NewBackend(key, server, sugar.With("component", "backend"), db, ch)
-	api.FillShipMapping()
-
 	var count int64
 	db.Table("clans").Count(&count)
 	if count < 1000 {
 		mainLogger.Infof("DB is empty, doing an initial complete scan, please wait (can take a few hours)")
-		err = api.ScrapAllClans()
+		err = api.ScrapAllClans(app.ctx)
+		if app.ctx.Err() != nil {
+			mainLogger.Infof("initial scan interrupted, exiting")
+			if disbot.Discord != nil {
+				disbot.Discord.Close()
+			}
+			shutdownServer()
+			return nil
+		}
 		if err != nil {
 			mainLogger.Errorf("first scan errored with: %s", err.Error())
 		}
 	}
 	s := gocron.NewScheduler(time.UTC)
-	mainLogger.Infof("adding 'updating all clans' task every 7 days")
-	s.Every(7).Days().At("10:30").Do(api.ScrapAllClans)
+	if cfg.Scan.FullScanMode == config.FullScanRolling {
+		mainLogger.Infof("adding 'updating 1/%d of all clans' task every day at %s", cfg.Scan.FullScanEveryDays, cfg.Scan.FullScanAt)
+		s.Every(1).Days().At(cfg.Scan.FullScanAt).Do(api.ScrapRollingShard, app.ctx)
+	} else {
+		mainLogger.Infof("adding 'updating all clans' task every %d days at %s", cfg.Scan.FullScanEveryDays, cfg.Scan.FullScanAt)
+		s.Every(cfg.Scan.FullScanEveryDays).Days().At(cfg.Scan.FullScanAt).Do(api.ScrapAllClans, app.ctx)
+	}
+
+	mainLogger.Infof("adding 'checking announced players' task every %s", cfg.Scan.AnnouncedInterval)
+	s.Every(cfg.Scan.AnnouncedInterval).Do(api.CheckAnnouncedPlayers, app.ctx)
 
-	mainLogger.Infof("adding 'updating monitored clans' task every 2 hours")
-	s.Every(2).Hours().Do(api.ScrapMonitoredClans)
+	if cfg.Wows.Cache.Enabled {
+		mainLogger.Infof("adding 'purging the API cache' task every hour")
+		s.Every(1).Hours().WaitForSchedule().Do(api.PurgeAPICache)
+	}
+
+	if cfg.Backup.Dir != "" {
+		mainLogger.Infof("adding 'backing up the DB' task every %s", cfg.Backup.Interval)
+		s.Every(cfg.Backup.Interval).WaitForSchedule().Do(func() {
+			_, err := storage.Backup(db, cfg.Backup.Dir, cfg.Backup.Keep, mainLogger)
+			if err != nil {
+				mainLogger.Errorf("DB backup failed: %s", err.Error())
+			}
+		})
+	}
+	if policy := cfg.Retention.Policy(); policy != (storage.RetentionPolicy{}) {
+		mainLogger.Infof("adding 'pruning old data' task every %s", cfg.Retention.Interval)
+		s.Every(cfg.Retention.Interval).WaitForSchedule().Do(func() {
+			report, err := storage.Prune(db, policy, cfg.Retention.DryRun)
+			if err != nil {
+				mainLogger.Errorf("pruning old data failed: %s", err.Error())
+				return
+			}
+			logRetentionReport(mainLogger, report, cfg.Retention.DryRun)
+		})
+	}
 	s.StartAsync()
 
-	disbot := bot.NewWowsBot(botToken, sugar.With("component", "discord_bot"), db, ch, botChanOSSig)
+	mainLogger.Infof("starting the monitored clans scheduler (priorities: high every %s, normal every %s, low every %s)",
+		cfg.Scan.HighPriorityInterval, cfg.Scan.MonitoredInterval, cfg.Scan.LowPriorityInterval)
+	schedulerDone := make(chan struct{})
+	go func() {
+		api.RunScheduler(app.ctx)
+		close(schedulerDone)
+	}()
 
 	var wg sync.WaitGroup
 
+	wg.Add(1)
 	go disbot.StartBot(&wg)
 
 	mainLogger.Infof("Bot is now running.  Press CTRL-C to exit.")
-	sc := make(chan os.Signal, 1)
-	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
-	sig := <-sc
-	botChanOSSig <- sig
+	<-app.ctx.Done()
+
+	// Running scans stop after the clan being written, the exits they detected are then sent by the bot before it stops
+	mainLogger.Infof("Stopping the scheduled tasks...")
+	s.Stop()
+	<-schedulerDone
+	botChanOSSig <- syscall.SIGTERM
 	wg.Wait()
+	shutdownServer()
+	mainLogger.Infof("Bot stopped")
+	return nil
+}
+
+func main() {
+	configPath := flag.String("config", config.DefaultPath, "configuration file (settings can be overridden by WOWS_* environment variables)")
+	flag.Usage = usage
+	flag.Parse()
+
+	// A missing configuration file is only an error if explicitly set
+	configRequired := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			configRequired = true
+		}
+	})
+	cfg, err := config.Load(*configPath, configRequired)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(-1)
+	}
+
+	args := flag.Args()
+	name := "serve"
+	if len(args) > 0 {
+		name = args[0]
+		args = args[1:]
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		flag.Usage()
+		os.Exit(-1)
+	}
+	if cmd.validate {
+		err = cfg.Validate()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(-1)
+		}
+	}
+
+	var loggerConfig zap.Config
+	if cfg.Debug {
+		loggerConfig = zap.NewDevelopmentConfig()
+	} else {
+		loggerConfig = zap.NewProductionConfig()
+	}
+
+	logger, err := loggerConfig.Build()
+	if err != nil {
+		fmt.Printf("Error initializing logger: %s\n", err.Error())
+		os.Exit(-1)
+	}
+	defer logger.Sync()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	app := &app{
+		ctx:     ctx,
+		cfg:     cfg,
+		logger:  logger.Sugar(),
+		glogger: zapgorm2.New(logger),
+	}
+	err = cmd.run(app, args)
+	if app.backend != nil {
+		// Saves the API requests done since the last flush of the scheduler
+		app.backend.FlushAPIUsage()
+	}
+	if errors.Is(err, ErrUsage) {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-config <file>] %s\n", os.Args[0], cmd.usage)
+		os.Exit(-1)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(-1)
+	}
 }
@@ -0,0 +1,176 @@
+package metrics
+
+import (
+	"context"
+	"github.com/kakwa/wows-recruiting-bot/model"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gorm.io/gorm"
+	"sync"
+	"time"
+)
+
+const namespace = "wows_recruiting"
+
+var (
+	APIRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_requests_total",
+		Help:      "Wargaming API requests by endpoint and result.",
+	}, []string{"endpoint", "result"})
+
+	APIKeyRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_key_requests_total",
+		Help:      "Wargaming API requests by application ID (masked).",
+	}, []string{"key"})
+
+	APIJobRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_job_requests_total",
+		Help:      "Wargaming API requests by job.",
+	}, []string{"job"})
+
+	APICacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_cache_requests_total",
+		Help:      "Wargaming API calls answered by the cache (hit) or sent to the API (miss), by endpoint.",
+	}, []string{"endpoint", "result"})
+
+	APIRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "api_request_duration_seconds",
+		Help:      "Wargaming API request durations by endpoint.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint"})
+
+	ClansScanned = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "clans_scanned_total",
+		Help:      "Clans scanned.",
+	})
+
+	PlayersScanned = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "players_scanned_total",
+		Help:      "Players scanned.",
+	})
+
+	ExitsDetected = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "exits_detected_total",
+		Help:      "Players detected leaving a clan.",
+	})
+
+	NotificationsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "notifications_sent_total",
+		Help:      "Exit notifications sent by Discord channel.",
+	}, []string{"channel"})
+
+	NotificationsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "notifications_failed_total",
+		Help:      "Exit notification send failures by Discord channel.",
+	}, []string{"channel"})
+
+	ScanDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "scan_duration_seconds",
+		Help:      "Duration of clan scans by scan type.",
+		// From 10 seconds to ~14 hours
+		Buckets: prometheus.ExponentialBuckets(10, 3, 9),
+	}, []string{"scan"})
+)
+
+// Record the duration of a scan started at 'start'
+func ObserveScan(scan string, start time.Time) {
+	ScanDuration.WithLabelValues(scan).Observe(time.Since(start).Seconds())
+}
+
+var (
+	pendingNotificationsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "pending_notifications"),
+		"Exit notifications waiting to be delivered.",
+		nil, nil,
+	)
+	dbRowsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "db_rows"),
+		"Number of rows by table.",
+		[]string{"table"}, nil,
+	)
+)
+
+// dbRowsInterval is the refresh interval of the rows counts, they are too slow to count at each scrape on large DBs
+const dbRowsInterval = 10 * time.Minute
+
+// Collector exposing gauges computed from the DB, the rows counts are refreshed in the background
+type DBCollector struct {
+	DB *gorm.DB
+
+	mutex sync.Mutex
+	rows  map[string]int64
+}
+
+func NewDBCollector(db *gorm.DB) *DBCollector {
+	return &DBCollector{DB: db}
+}
+
+func (c *DBCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pendingNotificationsDesc
+	ch <- dbRowsDesc
+}
+
+func (c *DBCollector) Collect(ch chan<- prometheus.Metric) {
+	var pending int64
+	if err := c.DB.Model(&model.Notification{}).Where("status = ?", model.NotificationPending).Count(&pending).Error; err == nil {
+		ch <- prometheus.MustNewConstMetric(pendingNotificationsDesc, prometheus.GaugeValue, float64(pending))
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for table, count := range c.rows {
+		ch <- prometheus.MustNewConstMetric(dbRowsDesc, prometheus.GaugeValue, float64(count), table)
+	}
+}
+
+// refreshRows counts the rows of each table
+func (c *DBCollector) refreshRows() {
+	// The tables are listed from the DB, the schema being defined by the migrations
+	tables, err := c.DB.Migrator().GetTables()
+	if err != nil {
+		return
+	}
+	rows := make(map[string]int64, len(tables))
+	for _, table := range tables {
+		var count int64
+		if err := c.DB.Table(table).Count(&count).Error; err != nil {
+			continue
+		}
+		rows[table] = count
+	}
+	c.mutex.Lock()
+	c.rows = rows
+	c.mutex.Unlock()
+}
+
+// RefreshRows counts the rows of the tables every interval until ctx is cancelled
+func (c *DBCollector) RefreshRows(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		c.refreshRows()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Register the DB collector on the default registry, its rows counts are refreshed until ctx is cancelled
+func RegisterDB(ctx context.Context, db *gorm.DB) {
+	collector := NewDBCollector(db)
+	prometheus.MustRegister(collector)
+	go collector.RefreshRows(ctx, dbRowsInterval)
+}
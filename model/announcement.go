@@ -0,0 +1,20 @@
+package model
+
+import (
+	"time"
+)
+
+// Announcement records the last time a player was announced in a Discord channel
+// and the player's statistics at that time
+type Announcement struct {
+	DiscordChannelID string `gorm:"primaryKey"`
+	PlayerID         int    `gorm:"primaryKey;autoIncrement:false"`
+	AnnouncedAt      time.Time
+	WinRate          float64
+	Battles          int
+	NumberT10        int
+	MessageID        string
+	// Last known state of the player, used to post follow-up updates
+	ClanID   int
+	Inactive bool
+}
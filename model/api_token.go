@@ -0,0 +1,16 @@
+package model
+
+import (
+	"gorm.io/gorm"
+	"time"
+)
+
+// APIToken grants access to the REST API for the filters of a Discord guild,
+// only the SHA-256 of the token is stored
+type APIToken struct {
+	gorm.Model
+	DiscordGuildID string `gorm:"index"`
+	Name           string
+	TokenHash      string `gorm:"uniqueIndex"`
+	LastUsedAt     time.Time
+}
@@ -0,0 +1,11 @@
+package model
+
+// APIUsage counts the Wargaming API requests of a day by job and application ID
+type APIUsage struct {
+	// Day in UTC, ex: 2023-04-19
+	Day string `gorm:"primaryKey"`
+	Job string `gorm:"primaryKey"`
+	// Masked application ID
+	Application string `gorm:"primaryKey"`
+	Requests    int64
+}
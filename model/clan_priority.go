@@ -0,0 +1,28 @@
+package model
+
+import (
+	"time"
+)
+
+// Scan priorities of the monitored clans
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+// Priorities from the most to the least urgent
+var Priorities = []string{PriorityHigh, PriorityNormal, PriorityLow}
+
+// ClanPriority sets how often a clan monitored by a filter is scanned, clans without one have the normal priority
+type ClanPriority struct {
+	DiscordChannelID string `gorm:"primaryKey"`
+	ClanID           int    `gorm:"primaryKey;autoIncrement:false"`
+	Priority         string
+}
+
+// ClanScan records the last scan of a clan, the scans of the monitored clans are scheduled from it
+type ClanScan struct {
+	ClanID   int `gorm:"primaryKey;autoIncrement:false"`
+	LastScan time.Time
+}
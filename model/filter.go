@@ -9,4 +9,11 @@ type Filter struct {
 	MinNumT10           int
 	MinNumBattles       int
 	DiscordGuildID      string
+	IgnoreJoinedClan    bool // Ignore players who already joined another clan
+	HomeClanID          int  // Clan recruiting from this channel
+	// Players already announced are not re-announced before CooldownDays
+	// unless their win rate or number of T10s changed by at least the following amounts
+	CooldownDays         int
+	CooldownMinWRChange  float64
+	CooldownMinT10Change int
 }
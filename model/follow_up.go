@@ -0,0 +1,31 @@
+package model
+
+import (
+	"gorm.io/gorm"
+	"time"
+)
+
+const (
+	FollowUpJoinedClan     = "joined_clan"
+	FollowUpJoinedHomeClan = "joined_home_clan"
+	FollowUpClanless       = "clanless"
+	FollowUpInactive       = "inactive"
+)
+
+// FollowUp is an update about an announced player, written by the backend
+// and used by the bot to edit the original announcement message.
+type FollowUp struct {
+	gorm.Model
+	DiscordChannelID string `gorm:"index"`
+	MessageID        string
+	PlayerID         int `gorm:"index"`
+	Nick             string
+	Event            string
+	ClanID           int
+	ClanTag          string
+	LastBattleDate   time.Time
+	Status           string `gorm:"index"`
+	Attempts         int
+	NextAttempt      time.Time `gorm:"index"`
+	LastError        string
+}
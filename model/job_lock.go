@@ -0,0 +1,14 @@
+package model
+
+import (
+	"time"
+)
+
+// JobLock is held by the bot instance running a job, it expires if its owner stops refreshing it
+type JobLock struct {
+	Name       string `gorm:"primaryKey"`
+	Job        string // Job holding the lock
+	Owner      string // Bot instance holding the lock
+	AcquiredAt time.Time
+	ExpiresAt  time.Time
+}
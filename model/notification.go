@@ -0,0 +1,49 @@
+package model
+
+import (
+	"gorm.io/gorm"
+	"time"
+)
+
+const (
+	NotificationPending = "pending"
+	NotificationSent    = "sent"
+	NotificationFailed  = "failed"
+	NotificationSkipped = "skipped"
+)
+
+// Notification is an entry of the notification outbox.
+// It is written by the backend when a player exit is detected and drained by the bot.
+// Player statistics are copied at detection time as later scans overwrite the player entry.
+type Notification struct {
+	gorm.Model
+	PlayerID       int `gorm:"index"`
+	Player         *Player
+	ClanID         int `gorm:"index"`
+	Clan           *Clan
+	Nick           string
+	WinRate        float64
+	Battles        int
+	NumberT10      int
+	LastBattleDate time.Time
+	HiddenProfile  bool
+	NewClanID      int // Clan joined by the player since, 0 if clanless
+	NewClanTag     string
+	Status         string `gorm:"index"`
+	Attempts       int
+	NextAttempt    time.Time `gorm:"index"`
+	LastError      string
+	Deliveries     []NotificationDelivery
+}
+
+// NotificationDelivery records the delivery of a Notification to a given Discord channel.
+type NotificationDelivery struct {
+	gorm.Model
+	NotificationID   uint   `gorm:"index"`
+	DiscordChannelID string `gorm:"index"`
+	Status           string `gorm:"index"`
+	Attempts         int
+	LastError        string
+	MessageID        string
+	SentAt           time.Time
+}
@@ -0,0 +1,25 @@
+package model
+
+import (
+	"gorm.io/gorm"
+	"time"
+)
+
+// PendingExit is a player exit held during the grace period before being announced.
+// It is discarded if the player is back in the clan before the end of the grace period.
+type PendingExit struct {
+	gorm.Model
+	PlayerID       int `gorm:"uniqueIndex:idx_pending_exit"`
+	ClanID         int `gorm:"uniqueIndex:idx_pending_exit"`
+	Clan           *Clan
+	DetectedAt     time.Time `gorm:"index"`
+	ClanJoinDate   time.Time // Recorded in the player's clan history once the exit is confirmed
+	Nick           string
+	WinRate        float64
+	Battles        int
+	NumberT10      int
+	LastBattleDate time.Time
+	HiddenProfile  bool
+	NewClanID      int // Clan joined by the player since, 0 if clanless
+	NewClanTag     string
+}
@@ -17,6 +17,7 @@ type Player struct {
 	WinRate             float64   `gorm:"index"`
 	HiddenProfile       bool      `gorm:"index"`
 	ClanID              int       `gorm:"index"`
+	ClanTag             string    `gorm:"-"` // Tag of the current clan as returned by the API, not stored
 	ClanJoinDate        time.Time
 	Clan                *Clan
 	Tracked             bool `gorm:"index"`
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/kakwa/wows-recruiting-bot/model"
+	"gorm.io/gorm"
+	"time"
+)
+
+var (
+	ErrInvalidToken = errors.New("Invalid API token")
+)
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIToken generates a token for a Discord guild, the token itself is only returned here
+func CreateAPIToken(db *gorm.DB, discordGuildID string, name string) (string, *model.APIToken, error) {
+	raw := make([]byte, 32)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", nil, err
+	}
+	token := hex.EncodeToString(raw)
+	apiToken := &model.APIToken{
+		DiscordGuildID: discordGuildID,
+		Name:           name,
+		TokenHash:      hashToken(token),
+	}
+	return token, apiToken, db.Create(apiToken).Error
+}
+
+// apiTokenUseResolution is the precision of the last use date of the API tokens, it's not written at each request
+const apiTokenUseResolution = time.Minute
+
+// GetAPIToken loads the API token matching token and records its use
+func GetAPIToken(db *gorm.DB, token string) (*model.APIToken, error) {
+	var apiToken model.APIToken
+	err := db.Where("token_hash = ?", hashToken(token)).First(&apiToken).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if time.Since(apiToken.LastUsedAt) < apiTokenUseResolution {
+		return &apiToken, nil
+	}
+	apiToken.LastUsedAt = time.Now()
+	return &apiToken, db.Model(&apiToken).Update("last_used_at", apiToken.LastUsedAt).Error
+}
+
+// RevokeAPIToken deletes an API token
+func RevokeAPIToken(db *gorm.DB, id uint) error {
+	result := db.Delete(&model.APIToken{}, id)
+	if result.Error == nil && result.RowsAffected == 0 {
+		return ErrInvalidToken
+	}
+	return result.Error
+}
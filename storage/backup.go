@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const backupPrefix = "wows-recruiting-bot-"
+
+var (
+	ErrBackupUnsupported = errors.New("Backups are only supported on SQLite DBs")
+	ErrInvalidBackup     = errors.New("Invalid backup")
+)
+
+// SQLitePath returns the path of the DB file of a sqlite:// DSN
+func SQLitePath(dsn string) (string, bool) {
+	if !strings.HasPrefix(dsn, "sqlite://") {
+		return "", false
+	}
+	return strings.TrimPrefix(dsn, "sqlite://"), true
+}
+
+// Backup copies the DB to a new file of dir while it's in use, only the 'keep' most recent backups are kept
+func Backup(db *gorm.DB, dir string, keep int, logger *zap.SugaredLogger) (string, error) {
+	if db.Dialector.Name() != "sqlite" {
+		return "", ErrBackupUnsupported
+	}
+	err := os.MkdirAll(dir, 0o750)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, backupPrefix+time.Now().UTC().Format("20060102-150405")+".db")
+	logger.Infof("Start backing up the DB to '%s'", path)
+	err = db.Exec("VACUUM INTO ?", path).Error
+	if err != nil {
+		return "", err
+	}
+	logger.Infof("Finish backing up the DB to '%s'", path)
+
+	// Timestamps in the names sort the backups from the oldest to the most recent
+	backups, err := filepath.Glob(filepath.Join(dir, backupPrefix+"*.db"))
+	if err != nil {
+		return path, err
+	}
+	sort.Strings(backups)
+	for len(backups) > keep {
+		logger.Infof("Removing old backup '%s'", backups[0])
+		err = os.Remove(backups[0])
+		if err != nil {
+			return path, err
+		}
+		backups = backups[1:]
+	}
+	return path, nil
+}
+
+// checkBackup verifies a backup file is a sound DB with a schema supported by this binary
+func checkBackup(path string) error {
+	_, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	db, err := Open("sqlite://"+path, &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidBackup, err.Error())
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	defer sqlDB.Close()
+
+	var integrity string
+	err = db.Raw("PRAGMA integrity_check").Scan(&integrity).Error
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidBackup, err.Error())
+	}
+	if integrity != "ok" {
+		return fmt.Errorf("%w: integrity check failed: %s", ErrInvalidBackup, integrity)
+	}
+	version, err := CurrentVersion(db)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidBackup, err.Error())
+	}
+	if version == 0 {
+		return fmt.Errorf("%w: no schema version, not a wows-recruiting-bot DB", ErrInvalidBackup)
+	}
+	if version > LatestVersion() {
+		return fmt.Errorf("%w (backup version: %d, supported version: %d)", ErrDBTooRecent, version, LatestVersion())
+	}
+	return nil
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Restore replaces the DB of the DSN by a backup, the bot must be stopped.
+// The current DB is kept next to it, the pending migrations are applied at the next start.
+func Restore(backupPath string, dsn string, logger *zap.SugaredLogger) error {
+	path, ok := SQLitePath(dsn)
+	if !ok {
+		return ErrBackupUnsupported
+	}
+	err := checkBackup(backupPath)
+	if err != nil {
+		return err
+	}
+
+	// The backup is copied next to the DB first, so the swap is a rename on the same filesystem
+	tmpPath := path + ".restore"
+	err = copyFile(backupPath, tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(path)
+	if err == nil {
+		previousPath := path + ".before-restore-" + time.Now().UTC().Format("20060102-150405")
+		logger.Infof("Moving the current DB to '%s'", previousPath)
+		err = os.Rename(path, previousPath)
+		if err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	for _, suffix := range []string{"-journal", "-wal", "-shm"} {
+		os.Remove(path + suffix)
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/kakwa/wows-recruiting-bot/model"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const copyBatchSize = 500
+
+// joinTables are the many2many tables, copied after the tables they join
+var joinTables = []string{
+	"filter_tracked_clan",
+	"filter_tracked_player",
+}
+
+func copyTable[T any](src *gorm.DB, dst *gorm.DB) (int64, error) {
+	var rows []T
+	var count int64
+	err := src.Unscoped().FindInBatches(&rows, copyBatchSize, func(tx *gorm.DB, batch int) error {
+		count += int64(len(rows))
+		return dst.Omit(clause.Associations).Clauses(clause.OnConflict{DoNothing: true}).Create(&rows).Error
+	}).Error
+	return count, err
+}
+
+// copyWholeTable copies tables without a single primary key, which can't be read in batches
+func copyWholeTable[T any](src *gorm.DB, dst *gorm.DB) (int64, error) {
+	var rows []T
+	err := src.Unscoped().Find(&rows).Error
+	if err != nil || len(rows) == 0 {
+		return 0, err
+	}
+	err = dst.Omit(clause.Associations).Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(&rows, copyBatchSize).Error
+	return int64(len(rows)), err
+}
+
+func copyJoinTable(src *gorm.DB, dst *gorm.DB, table string) (int64, error) {
+	var rows []map[string]interface{}
+	err := src.Table(table).Find(&rows).Error
+	if err != nil || len(rows) == 0 {
+		return 0, err
+	}
+	err = dst.Table(table).Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(&rows, copyBatchSize).Error
+	return int64(len(rows)), err
+}
+
+// Copy copies the content of the src DB into the dst DB, creating the schema in dst if necessary.
+// It is meant to migrate from one DB backend to another, for example from sqlite to PostgreSQL.
+func Copy(src *gorm.DB, dst *gorm.DB, logger *zap.SugaredLogger) error {
+	version, err := CurrentVersion(src)
+	if err != nil {
+		return err
+	}
+	if version != LatestVersion() {
+		return fmt.Errorf("source DB schema version is %d instead of %d, please migrate it first", version, LatestVersion())
+	}
+	err = Migrate(dst, logger)
+	if err != nil {
+		return err
+	}
+
+	copiers := []struct {
+		table string
+		copy  func(src *gorm.DB, dst *gorm.DB) (int64, error)
+	}{
+		{"clans", copyTable[model.Clan]},
+		{"players", copyTable[model.Player]},
+		{"previous_clans", copyTable[model.PreviousClan]},
+		{"filters", copyTable[model.Filter]},
+		{"notifications", copyTable[model.Notification]},
+		{"notification_deliveries", copyTable[model.NotificationDelivery]},
+		{"announcements", copyWholeTable[model.Announcement]},
+		{"pending_exits", copyTable[model.PendingExit]},
+		{"follow_ups", copyTable[model.FollowUp]},
+		{"api_tokens", copyTable[model.APIToken]},
+		{"clan_priorities", copyWholeTable[model.ClanPriority]},
+		{"clan_scans", copyTable[model.ClanScan]},
+		{"api_usages", copyWholeTable[model.APIUsage]},
+		// job_locks are not copied, they are only valid for the running instances
+	}
+	for _, copier := range copiers {
+		logger.Infof("Start copying table '%s'", copier.table)
+		count, err := copier.copy(src, dst)
+		if err != nil {
+			return fmt.Errorf("copying table '%s': %w", copier.table, err)
+		}
+		logger.Infof("Finish copying %d rows of table '%s'", count, copier.table)
+	}
+	for _, table := range joinTables {
+		logger.Infof("Start copying table '%s'", table)
+		count, err := copyJoinTable(src, dst, table)
+		if err != nil {
+			return fmt.Errorf("copying table '%s': %w", table, err)
+		}
+		logger.Infof("Finish copying %d rows of table '%s'", count, table)
+	}
+
+	// IDs were copied explicitly, PostgreSQL sequences must be moved past them
+	if dst.Dialector.Name() == "postgres" {
+		for _, copier := range copiers {
+			if !dst.Migrator().HasColumn(copier.table, "id") {
+				continue
+			}
+			err = dst.Exec(fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%s', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM %s", copier.table, copier.table)).Error
+			if err != nil {
+				return fmt.Errorf("resetting sequence of table '%s': %w", copier.table, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"github.com/kakwa/wows-recruiting-bot/model"
+	"gorm.io/gorm"
+	"time"
+)
+
+// RecentExits returns the exits detected since 'since' from the clans monitored in a Discord guild, most recent first
+func RecentExits(db *gorm.DB, discordGuildID string, since time.Time, limit int) ([]model.Notification, error) {
+	trackedClans := db.Table("filter_tracked_clan").
+		Select("filter_tracked_clan.clan_id").
+		Joins("JOIN filters ON filters.discord_channel_id = filter_tracked_clan.filter_discord_channel_id").
+		Where("filters.discord_guild_id = ?", discordGuildID)
+	var notifications []model.Notification
+	err := db.Preload("Clan").
+		Where("clan_id IN (?) AND created_at > ?", trackedClans, since).
+		Order("created_at DESC").
+		Limit(limit).
+		Find(&notifications).Error
+	return notifications, err
+}
+
+// ClanChurn returns the number of players who left each clan since 'since'
+func ClanChurn(db *gorm.DB, clanIDs []int, since time.Time) (map[int]int, error) {
+	var rows []struct {
+		ClanID int
+		Exits  int
+	}
+	err := db.Model(&model.PreviousClan{}).
+		Select("clan_id, COUNT(*) AS exits").
+		Where("clan_id IN ? AND leave_date > ?", clanIDs, since).
+		Group("clan_id").
+		Scan(&rows).Error
+	churn := make(map[int]int, len(rows))
+	for _, row := range rows {
+		churn[row.ClanID] = row.Exits
+	}
+	return churn, err
+}
+
+// ClanMembers returns the number of known players in each clan
+func ClanMembers(db *gorm.DB, clanIDs []int) (map[int]int, error) {
+	var rows []struct {
+		ClanID  int
+		Members int
+	}
+	err := db.Model(&model.Player{}).
+		Select("clan_id, COUNT(*) AS members").
+		Where("clan_id IN ?", clanIDs).
+		Group("clan_id").
+		Scan(&rows).Error
+	members := make(map[int]int, len(rows))
+	for _, row := range rows {
+		members[row.ClanID] = row.Members
+	}
+	return members, err
+}
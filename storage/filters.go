@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"errors"
+	"github.com/kakwa/wows-recruiting-bot/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrFilterNotFound = errors.New("Filter doesn't seem to be set for this channel")
+	ErrClanNotFound   = errors.New("Clan doesn't seem to exist")
+)
+
+// GetFilter loads the filter of a Discord channel with its tracked clans
+func GetFilter(db *gorm.DB, discordChannelID string) (*model.Filter, error) {
+	filter := &model.Filter{DiscordChannelID: discordChannelID}
+	err := db.Preload("TrackedClans").First(filter).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrFilterNotFound
+	}
+	return filter, err
+}
+
+// SaveFilterCriterias creates or updates the filter criterias, keeping the other settings of the channel
+func SaveFilterCriterias(db *gorm.DB, filter *model.Filter) error {
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "discord_channel_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"discord_guild_id", "min_num_t10", "days_since_last_battle", "min_num_battles", "min_player_wr", "ignore_joined_clan"}),
+	}).Omit(clause.Associations).Create(filter).Error
+}
+
+// GetClanByTag loads a clan from its tag
+func GetClanByTag(db *gorm.DB, clanTag string) (*model.Clan, error) {
+	var clan model.Clan
+	err := db.Where("tag = ?", clanTag).First(&clan).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrClanNotFound
+	}
+	return &clan, err
+}
+
+// TrackClan adds a clan to the clans monitored by the filter
+func TrackClan(db *gorm.DB, filter *model.Filter, clanTag string) (*model.Clan, error) {
+	clan, err := GetClanByTag(db, clanTag)
+	if err != nil {
+		return nil, err
+	}
+	clan.Tracked = true
+	err = db.Save(clan).Error
+	if err != nil {
+		return nil, err
+	}
+	return clan, db.Model(filter).Association("TrackedClans").Append(clan)
+}
+
+// UntrackClan removes a clan from the clans monitored by the filter
+func UntrackClan(db *gorm.DB, filter *model.Filter, clanTag string) (*model.Clan, error) {
+	clan, err := GetClanByTag(db, clanTag)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Delete(&model.ClanPriority{DiscordChannelID: filter.DiscordChannelID, ClanID: clan.ID}).Error
+	if err != nil {
+		return nil, err
+	}
+	return clan, db.Model(filter).Association("TrackedClans").Delete(clan)
+}
+
+// ReplaceTrackedClans replaces all the clans monitored by the filter, it returns the unknown clan tags
+func ReplaceTrackedClans(db *gorm.DB, filter *model.Filter, clanTags []string) ([]string, error) {
+	err := db.Model(filter).Association("TrackedClans").Delete(filter.TrackedClans)
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	for _, clanTag := range clanTags {
+		_, err = TrackClan(db, filter, clanTag)
+		if errors.Is(err, ErrClanNotFound) {
+			missing = append(missing, clanTag)
+			continue
+		}
+		if err != nil {
+			return missing, err
+		}
+	}
+	return missing, nil
+}
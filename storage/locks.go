@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"errors"
+	"github.com/kakwa/wows-recruiting-bot/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"strconv"
+	"time"
+)
+
+var ErrLockLost = errors.New("Job lock lost")
+
+// tryLock takes a lock if it's free or expired
+func tryLock(db *gorm.DB, name string, job string, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	lock := &model.JobLock{Name: name, Job: job, Owner: owner, AcquiredAt: now, ExpiresAt: now.Add(ttl)}
+	result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(lock)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 1 {
+		return true, nil
+	}
+
+	// Take over an expired lock, the condition makes it atomic between instances
+	result = db.Model(&model.JobLock{}).Where("name = ? AND expires_at < ?", name, now).
+		Updates(map[string]interface{}{"job": job, "owner": owner, "acquired_at": now, "expires_at": now.Add(ttl)})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// AcquireLock takes the lock for a job if it's free or expired.
+// If the lock is held, it's returned to report who holds it (nil if it was released meanwhile).
+func AcquireLock(db *gorm.DB, name string, job string, owner string, ttl time.Duration) (bool, *model.JobLock, error) {
+	acquired, err := tryLock(db, name, job, owner, ttl)
+	if err != nil || acquired {
+		return acquired, nil, err
+	}
+	var holder model.JobLock
+	err = db.Where("name = ?", name).First(&holder).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// Released in the meantime
+		return false, nil, nil
+	}
+	if err != nil {
+		return false, nil, err
+	}
+	return false, &holder, nil
+}
+
+// RefreshLock extends the expiration of a lock held by owner
+func RefreshLock(db *gorm.DB, name string, owner string, ttl time.Duration) error {
+	result := db.Model(&model.JobLock{}).Where("name = ? AND owner = ?", name, owner).Update("expires_at", time.Now().Add(ttl))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrLockLost
+	}
+	return nil
+}
+
+// ReleaseLock frees a lock held by owner
+func ReleaseLock(db *gorm.DB, name string, owner string) error {
+	return db.Where("name = ? AND owner = ?", name, owner).Delete(&model.JobLock{}).Error
+}
+
+// ClanLockName returns the name of the lock claimed by a job scanning a clan
+func ClanLockName(clanID int) string {
+	return "clan:" + strconv.Itoa(clanID)
+}
+
+// ClaimClans takes the locks of the clans which are free or expired, it returns the claimed clans.
+// The other clans are being scanned by another job.
+func ClaimClans(db *gorm.DB, clanIDs []int, job string, owner string, ttl time.Duration) ([]int, error) {
+	var claimed []int
+	for _, clanID := range clanIDs {
+		acquired, err := tryLock(db, ClanLockName(clanID), job, owner, ttl)
+		if err != nil {
+			return claimed, err
+		}
+		if acquired {
+			claimed = append(claimed, clanID)
+		}
+	}
+	return claimed, nil
+}
+
+// ReleaseClans frees the locks of clans claimed by owner
+func ReleaseClans(db *gorm.DB, clanIDs []int, owner string) error {
+	if len(clanIDs) == 0 {
+		return nil
+	}
+	names := make([]string, len(clanIDs))
+	for i, clanID := range clanIDs {
+		names[i] = ClanLockName(clanID)
+	}
+	return db.Where("name IN ? AND owner = ?", names, owner).Delete(&model.JobLock{}).Error
+}
+
+// RefreshClanClaims extends the expiration of the clan locks claimed by owner
+func RefreshClanClaims(db *gorm.DB, owner string, ttl time.Duration) error {
+	return db.Model(&model.JobLock{}).Where("name LIKE 'clan:%' AND owner = ?", owner).Update("expires_at", time.Now().Add(ttl)).Error
+}
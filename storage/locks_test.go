@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAcquireLock(t *testing.T) {
+	tests := []struct {
+		name string
+		// Lock held before the acquisition, its owner is "other"
+		heldTTL  time.Duration
+		held     bool
+		acquired bool
+	}{
+		{name: "free", acquired: true},
+		{name: "held", held: true, heldTTL: time.Minute, acquired: false},
+		{name: "expired", held: true, heldTTL: -time.Second, acquired: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := OpenTestDB(t)
+			if test.held {
+				acquired, _, err := AcquireLock(db, "scan", "full_scan", "other", test.heldTTL)
+				if err != nil || !acquired {
+					t.Fatalf("failed to take the initial lock: %v", err)
+				}
+			}
+			acquired, holder, err := AcquireLock(db, "scan", "monitored_scan", "me", time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if acquired != test.acquired {
+				t.Fatalf("acquired = %t, expected %t", acquired, test.acquired)
+			}
+			if !acquired && (holder == nil || holder.Owner != "other" || holder.Job != "full_scan") {
+				t.Fatalf("unexpected holder %+v", holder)
+			}
+			if acquired {
+				// Refreshed by the new owner only
+				if err := RefreshLock(db, "scan", "me", time.Minute); err != nil {
+					t.Fatalf("refresh by the owner: %v", err)
+				}
+				if err := RefreshLock(db, "scan", "other", time.Minute); err != ErrLockLost {
+					t.Fatalf("refresh by the previous owner: %v, expected ErrLockLost", err)
+				}
+			}
+		})
+	}
+}
+
+func TestReleaseLock(t *testing.T) {
+	db := OpenTestDB(t)
+	if acquired, _, err := AcquireLock(db, "scan", "full_scan", "me", time.Minute); err != nil || !acquired {
+		t.Fatalf("failed to take the lock: %v", err)
+	}
+	// Only the owner releases the lock
+	if err := ReleaseLock(db, "scan", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if acquired, _, _ := AcquireLock(db, "scan", "full_scan", "other", time.Minute); acquired {
+		t.Fatal("lock released by another owner")
+	}
+	if err := ReleaseLock(db, "scan", "me"); err != nil {
+		t.Fatal(err)
+	}
+	if acquired, _, _ := AcquireLock(db, "scan", "full_scan", "other", time.Minute); !acquired {
+		t.Fatal("lock not released by its owner")
+	}
+}
+
+func TestClaimClans(t *testing.T) {
+	db := OpenTestDB(t)
+	claimed, err := ClaimClans(db, []int{1, 2}, "full_scan", "a/full_scan", time.Minute)
+	if err != nil || !reflect.DeepEqual(claimed, []int{1, 2}) {
+		t.Fatalf("first claim = %v, %v", claimed, err)
+	}
+	// Clan 3 is claimed with an expired lock, it can be taken over
+	if _, err := ClaimClans(db, []int{3}, "full_scan", "a/full_scan", -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	claimed, err = ClaimClans(db, []int{1, 3, 4}, "monitored_scan", "a/monitored_scan", time.Minute)
+	if err != nil || !reflect.DeepEqual(claimed, []int{3, 4}) {
+		t.Fatalf("overlapping claim = %v, %v", claimed, err)
+	}
+	if err := ReleaseClans(db, []int{1, 2, 3}, "a/full_scan"); err != nil {
+		t.Fatal(err)
+	}
+	// Clan 3 was taken over, it is still claimed by the monitored scan
+	claimed, err = ClaimClans(db, []int{1, 2, 3}, "clan_scan", "a/clan_scan", time.Minute)
+	if err != nil || !reflect.DeepEqual(claimed, []int{1, 2}) {
+		t.Fatalf("claim after release = %v, %v", claimed, err)
+	}
+}
@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kakwa/wows-recruiting-bot/storage/schemav1"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"time"
+)
+
+var (
+	ErrDBTooRecent = errors.New("DB schema is more recent than this binary, please upgrade wows-recruiting-bot")
+)
+
+// SchemaMigration records a migration applied to the DB
+type SchemaMigration struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// Migration is a schema change, migrations are applied in order and only once.
+// Migrations must never be modified once released, add a new one instead.
+// They use frozen copies of the models, never the model package, so that a migration
+// creates the same schema whatever the later changes of the models.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+}
+
+var Migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(
+				&schemav1.Clan{},
+				&schemav1.Player{},
+				&schemav1.PreviousClan{},
+				&schemav1.Filter{},
+				&schemav1.Notification{},
+				&schemav1.NotificationDelivery{},
+				&schemav1.Announcement{},
+				&schemav1.PendingExit{},
+				&schemav1.FollowUp{},
+			)
+		},
+	},
+	{
+		Version: 2,
+		Name:    "api tokens",
+		Up: func(tx *gorm.DB) error {
+			type APIToken struct {
+				gorm.Model
+				DiscordGuildID string `gorm:"index"`
+				Name           string
+				TokenHash      string `gorm:"uniqueIndex"`
+				LastUsedAt     time.Time
+			}
+			return tx.AutoMigrate(&APIToken{})
+		},
+	},
+	{
+		Version: 3,
+		Name:    "job locks",
+		Up: func(tx *gorm.DB) error {
+			type JobLock struct {
+				Name       string `gorm:"primaryKey"`
+				Job        string
+				Owner      string
+				AcquiredAt time.Time
+				ExpiresAt  time.Time
+			}
+			return tx.AutoMigrate(&JobLock{})
+		},
+	},
+	{
+		Version: 4,
+		Name:    "clan priorities and scans",
+		Up: func(tx *gorm.DB) error {
+			type ClanPriority struct {
+				DiscordChannelID string `gorm:"primaryKey"`
+				ClanID           int    `gorm:"primaryKey;autoIncrement:false"`
+				Priority         string
+			}
+			type ClanScan struct {
+				ClanID   int `gorm:"primaryKey;autoIncrement:false"`
+				LastScan time.Time
+			}
+			return tx.AutoMigrate(&ClanPriority{}, &ClanScan{})
+		},
+	},
+	{
+		Version: 5,
+		Name:    "api usage",
+		Up: func(tx *gorm.DB) error {
+			type APIUsage struct {
+				Day         string `gorm:"primaryKey"`
+				Job         string `gorm:"primaryKey"`
+				Application string `gorm:"primaryKey"`
+				Requests    int64
+			}
+			return tx.AutoMigrate(&APIUsage{})
+		},
+	},
+}
+
+// LatestVersion returns the schema version expected by this binary
+func LatestVersion() int {
+	return Migrations[len(Migrations)-1].Version
+}
+
+// CurrentVersion returns the schema version of the DB, 0 if no migration was applied
+func CurrentVersion(db *gorm.DB) (int, error) {
+	if !db.Migrator().HasTable(&SchemaMigration{}) {
+		return 0, nil
+	}
+	var version int
+	err := db.Model(&SchemaMigration{}).Select("COALESCE(MAX(version), 0)").Scan(&version).Error
+	return version, err
+}
+
+// PendingMigrations returns the migrations not yet applied to the DB
+func PendingMigrations(db *gorm.DB) ([]Migration, error) {
+	version, err := CurrentVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	if version > LatestVersion() {
+		return nil, fmt.Errorf("%w (DB version: %d, supported version: %d)", ErrDBTooRecent, version, LatestVersion())
+	}
+	var pending []Migration
+	for _, migration := range Migrations {
+		if migration.Version > version {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies the pending migrations, it refuses to run on a DB more recent than the binary
+func Migrate(db *gorm.DB, logger *zap.SugaredLogger) error {
+	err := db.AutoMigrate(&SchemaMigration{})
+	if err != nil {
+		return err
+	}
+	pending, err := PendingMigrations(db)
+	if err != nil {
+		return err
+	}
+	for _, migration := range pending {
+		logger.Infof("Applying DB migration %d (%s)", migration.Version, migration.Name)
+		err = db.Transaction(func(tx *gorm.DB) error {
+			err := migration.Up(tx)
+			if err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{
+				Version:   migration.Version,
+				Name:      migration.Name,
+				AppliedAt: time.Now(),
+			}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", migration.Version, migration.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"errors"
+	"github.com/kakwa/wows-recruiting-bot/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+var (
+	ErrUnknownPriority = errors.New("Unknown priority, expected 'high', 'normal' or 'low'")
+	ErrClanNotTracked  = errors.New("Clan isn't monitored by this channel")
+)
+
+// priorityRank orders the priorities, the most urgent has the highest rank
+func priorityRank(priority string) int {
+	for i, p := range model.Priorities {
+		if p == priority {
+			return len(model.Priorities) - i
+		}
+	}
+	return 0
+}
+
+// SetClanPriority sets the scan priority of a clan monitored by the filter, the filter must be loaded with its tracked clans
+func SetClanPriority(db *gorm.DB, filter *model.Filter, clanTag string, priority string) (*model.Clan, error) {
+	if priorityRank(priority) == 0 {
+		return nil, ErrUnknownPriority
+	}
+	clan, err := GetClanByTag(db, clanTag)
+	if err != nil {
+		return nil, err
+	}
+	tracked := false
+	for _, trackedClan := range filter.TrackedClans {
+		tracked = tracked || trackedClan.ID == clan.ID
+	}
+	if !tracked {
+		return nil, ErrClanNotTracked
+	}
+	clanPriority := &model.ClanPriority{DiscordChannelID: filter.DiscordChannelID, ClanID: clan.ID, Priority: priority}
+	if priority == model.PriorityNormal {
+		return clan, db.Delete(clanPriority).Error
+	}
+	return clan, db.Clauses(clause.OnConflict{UpdateAll: true}).Create(clanPriority).Error
+}
+
+// FilterClanPriorities returns the priorities set by a filter, by clan ID
+func FilterClanPriorities(db *gorm.DB, discordChannelID string) (map[int]string, error) {
+	var clanPriorities []model.ClanPriority
+	err := db.Where("discord_channel_id = ?", discordChannelID).Find(&clanPriorities).Error
+	priorities := make(map[int]string, len(clanPriorities))
+	for _, clanPriority := range clanPriorities {
+		priorities[clanPriority.ClanID] = clanPriority.Priority
+	}
+	return priorities, err
+}
+
+// MonitoredClanPriorities returns the monitored clans with their scan priority,
+// the most urgent priority set by the filters monitoring a clan wins
+func MonitoredClanPriorities(db *gorm.DB) (map[int]string, error) {
+	var clanIDs []int
+	err := db.Model(&model.Clan{}).Where("tracked = ?", true).Pluck("id", &clanIDs).Error
+	if err != nil {
+		return nil, err
+	}
+	// Clans monitored by a filter without priority are normal
+	var rows []struct {
+		ClanID   int
+		Priority string
+	}
+	err = db.Table("filter_tracked_clan").
+		Select("filter_tracked_clan.clan_id, COALESCE(clan_priorities.priority, ?) AS priority", model.PriorityNormal).
+		Joins("LEFT JOIN clan_priorities ON clan_priorities.clan_id = filter_tracked_clan.clan_id AND clan_priorities.discord_channel_id = filter_tracked_clan.filter_discord_channel_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	// Clans still flagged as tracked without filter keep the normal priority
+	priorities := make(map[int]string, len(clanIDs))
+	for _, clanID := range clanIDs {
+		priorities[clanID] = model.PriorityNormal
+	}
+	fromFilters := make(map[int]bool, len(clanIDs))
+	for _, row := range rows {
+		if _, ok := priorities[row.ClanID]; !ok {
+			continue
+		}
+		if !fromFilters[row.ClanID] || priorityRank(row.Priority) > priorityRank(priorities[row.ClanID]) {
+			priorities[row.ClanID] = row.Priority
+			fromFilters[row.ClanID] = true
+		}
+	}
+	return priorities, nil
+}
+
+// LastScans returns the time of the last scan of each clan, clans never scanned are missing
+func LastScans(db *gorm.DB, clanIDs []int) (map[int]time.Time, error) {
+	var clanScans []model.ClanScan
+	err := db.Where("clan_id IN ?", clanIDs).Find(&clanScans).Error
+	lastScans := make(map[int]time.Time, len(clanScans))
+	for _, clanScan := range clanScans {
+		lastScans[clanScan.ClanID] = clanScan.LastScan
+	}
+	return lastScans, err
+}
+
+// MarkClansScanned records the scan of clans
+func MarkClansScanned(db *gorm.DB, clanIDs []int, scannedAt time.Time) error {
+	if len(clanIDs) == 0 {
+		return nil
+	}
+	clanScans := make([]model.ClanScan, len(clanIDs))
+	for i, clanID := range clanIDs {
+		clanScans[i] = model.ClanScan{ClanID: clanID, LastScan: scannedAt}
+	}
+	return db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&clanScans).Error
+}
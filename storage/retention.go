@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"github.com/kakwa/wows-recruiting-bot/model"
+	"gorm.io/gorm"
+	"reflect"
+	"time"
+)
+
+// RetentionPolicy sets the age after which data is pruned, a zero age keeps the data forever
+type RetentionPolicy struct {
+	// Stats snapshots: delivered notifications, follow-ups and announcements
+	SnapshotsAge time.Duration
+	// Clans not updated by the scans for this duration are considered disbanded and archived (soft deleted)
+	ArchiveClansAge time.Duration
+	// Players without a battle for this duration who are in no monitored clan
+	InactivePlayersAge time.Duration
+	// Clan history of the players
+	PreviousClansAge time.Duration
+}
+
+// RetentionReport counts the rows pruned (or to be pruned in dry-run) by table
+type RetentionReport struct {
+	Notifications          int64
+	NotificationDeliveries int64
+	FollowUps              int64
+	Announcements          int64
+	ArchivedClans          int64
+	Players                int64
+	PreviousClans          int64
+}
+
+// retentionRule deletes the rows of a table matched by a query, rules run in order
+type retentionRule struct {
+	age   time.Duration
+	model interface{}
+	count *int64
+	// where returns the conditions matching the rows to delete for the cutoff date
+	where func(tx *gorm.DB, cutoff time.Time) *gorm.DB
+	// archive soft deletes the rows instead of deleting them
+	archive bool
+}
+
+func (policy RetentionPolicy) rules(report *RetentionReport) []retentionRule {
+	// Sub-queries are built on their own session, they must not share the conditions of the rule
+	subQuery := func(tx *gorm.DB) *gorm.DB {
+		return tx.Session(&gorm.Session{NewDB: true})
+	}
+	monitoredClans := func(tx *gorm.DB) *gorm.DB {
+		return subQuery(tx).Model(&model.Clan{}).Select("id").Where("tracked = ?", true)
+	}
+	// Hidden profiles have no last battle date, they are pruned once they are not seen in any clan
+	inactivePlayers := func(tx *gorm.DB, cutoff time.Time) *gorm.DB {
+		return tx.Where("tracked = ?", false).
+			Where("(hidden_profile = ? AND last_battle_date < ?) OR (hidden_profile = ? AND updated_at < ?)", false, cutoff, true, cutoff).
+			Where("clan_id IS NULL OR clan_id NOT IN (?)", monitoredClans(tx))
+	}
+
+	return []retentionRule{
+		{
+			age:   policy.SnapshotsAge,
+			model: &model.NotificationDelivery{},
+			count: &report.NotificationDeliveries,
+			where: func(tx *gorm.DB, cutoff time.Time) *gorm.DB {
+				processed := subQuery(tx).Model(&model.Notification{}).Select("id").
+					Where("created_at < ? AND status != ?", cutoff, model.NotificationPending)
+				return tx.Where("notification_id IN (?)", processed)
+			},
+		},
+		{
+			age:   policy.SnapshotsAge,
+			model: &model.Notification{},
+			count: &report.Notifications,
+			where: func(tx *gorm.DB, cutoff time.Time) *gorm.DB {
+				return tx.Where("created_at < ? AND status != ?", cutoff, model.NotificationPending)
+			},
+		},
+		{
+			age:   policy.SnapshotsAge,
+			model: &model.FollowUp{},
+			count: &report.FollowUps,
+			where: func(tx *gorm.DB, cutoff time.Time) *gorm.DB {
+				return tx.Where("created_at < ? AND status != ?", cutoff, model.NotificationPending)
+			},
+		},
+		{
+			age:   policy.SnapshotsAge,
+			model: &model.Announcement{},
+			count: &report.Announcements,
+			where: func(tx *gorm.DB, cutoff time.Time) *gorm.DB {
+				return tx.Where("announced_at < ?", cutoff)
+			},
+		},
+		{
+			age:     policy.ArchiveClansAge,
+			model:   &model.Clan{},
+			count:   &report.ArchivedClans,
+			archive: true,
+			where: func(tx *gorm.DB, cutoff time.Time) *gorm.DB {
+				homeClans := subQuery(tx).Model(&model.Filter{}).Select("home_clan_id")
+				return tx.Where("updated_at < ? AND tracked = ?", cutoff, false).Where("id NOT IN (?)", homeClans)
+			},
+		},
+		{
+			age:   policy.InactivePlayersAge,
+			model: &model.PreviousClan{},
+			count: &report.PreviousClans,
+			where: func(tx *gorm.DB, cutoff time.Time) *gorm.DB {
+				return tx.Where("player_id IN (?)", inactivePlayers(subQuery(tx).Model(&model.Player{}).Select("id"), cutoff))
+			},
+		},
+		{
+			age:   policy.InactivePlayersAge,
+			model: &model.Player{},
+			count: &report.Players,
+			where: inactivePlayers,
+		},
+		{
+			age:   policy.PreviousClansAge,
+			model: &model.PreviousClan{},
+			count: &report.PreviousClans,
+			where: func(tx *gorm.DB, cutoff time.Time) *gorm.DB {
+				return tx.Where("leave_date < ?", cutoff)
+			},
+		},
+	}
+}
+
+// pruneBatchSize is the number of rows deleted at once, each batch is a short transaction
+const pruneBatchSize = 1000
+
+// Prune deletes the data older than the policy ages and reports the number of rows deleted.
+// In dry-run, the rows to delete are only counted, rows matched by two rules are counted twice.
+func Prune(db *gorm.DB, policy RetentionPolicy, dryRun bool) (*RetentionReport, error) {
+	report := &RetentionReport{}
+	now := time.Now()
+	for _, rule := range policy.rules(report) {
+		if rule.age <= 0 {
+			continue
+		}
+		query := func() *gorm.DB {
+			query := rule.where(db.Session(&gorm.Session{NewDB: true}).Model(rule.model), now.Add(-rule.age))
+			if !rule.archive {
+				query = query.Unscoped()
+			}
+			return query
+		}
+		if dryRun {
+			var count int64
+			err := query().Count(&count).Error
+			if err != nil {
+				return report, err
+			}
+			*rule.count += count
+			continue
+		}
+		deleted, err := pruneRule(db, rule, query)
+		*rule.count += deleted
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// pruneRule deletes the rows matched by a rule by batches, selecting their primary keys first
+func pruneRule(db *gorm.DB, rule retentionRule, query func() *gorm.DB) (int64, error) {
+	stmt := &gorm.Statement{DB: db}
+	err := stmt.Parse(rule.model)
+	if err != nil {
+		return 0, err
+	}
+	var deleted int64
+	for {
+		rows := reflect.New(reflect.SliceOf(reflect.TypeOf(rule.model).Elem()))
+		err := query().Select(stmt.Schema.PrimaryFieldDBNames).Limit(pruneBatchSize).Find(rows.Interface()).Error
+		if err != nil {
+			return deleted, err
+		}
+		if rows.Elem().Len() == 0 {
+			return deleted, nil
+		}
+		// Deleted by primary keys
+		tx := db.Session(&gorm.Session{NewDB: true})
+		if !rule.archive {
+			tx = tx.Unscoped()
+		}
+		result := tx.Delete(rows.Interface())
+		if result.Error != nil {
+			return deleted, result.Error
+		}
+		deleted += result.RowsAffected
+		if rows.Elem().Len() < pruneBatchSize || result.RowsAffected == 0 {
+			return deleted, nil
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"github.com/kakwa/wows-recruiting-bot/model"
+	"gorm.io/gorm"
+	"testing"
+	"time"
+)
+
+var testPolicy = RetentionPolicy{
+	SnapshotsAge:       90 * 24 * time.Hour,
+	ArchiveClansAge:    90 * 24 * time.Hour,
+	InactivePlayersAge: 365 * 24 * time.Hour,
+	PreviousClansAge:   2 * 365 * 24 * time.Hour,
+}
+
+// retentionFixtures writes rows on both sides of testPolicy, the rows to prune have a "prune" name, tag or channel
+func retentionFixtures(t *testing.T, db *gorm.DB) {
+	t.Helper()
+	old := time.Now().Add(-3 * 365 * 24 * time.Hour)
+	recent := time.Now().Add(-24 * time.Hour)
+	rows := []interface{}{
+		&model.Clan{ID: 1, Tag: "keep-monitored", Tracked: true, Model: gorm.Model{UpdatedAt: old}},
+		&model.Clan{ID: 2, Tag: "prune", Model: gorm.Model{UpdatedAt: old}},
+		&model.Clan{ID: 3, Tag: "keep-recent", Model: gorm.Model{UpdatedAt: recent}},
+		&model.Clan{ID: 4, Tag: "keep-home", Model: gorm.Model{UpdatedAt: old}},
+		&model.Filter{DiscordChannelID: "channel", HomeClanID: 4},
+		&model.Player{ID: 10, Nick: "keep-monitored", ClanID: 1, LastBattleDate: old},
+		&model.Player{ID: 11, Nick: "prune", ClanID: 2, LastBattleDate: old},
+		&model.Player{ID: 12, Nick: "keep-active", LastBattleDate: recent},
+		&model.PreviousClan{PlayerID: 11, ClanID: 3, LeaveDate: recent},
+		&model.PreviousClan{PlayerID: 12, ClanID: 3, LeaveDate: old},
+		&model.PreviousClan{PlayerID: 12, ClanID: 2, LeaveDate: recent},
+		&model.Notification{Nick: "prune", Status: model.NotificationSent, Model: gorm.Model{ID: 100, CreatedAt: old}},
+		&model.Notification{Nick: "keep-pending", Status: model.NotificationPending, Model: gorm.Model{ID: 101, CreatedAt: old}},
+		&model.Notification{Nick: "keep-recent", Status: model.NotificationSent, Model: gorm.Model{ID: 102, CreatedAt: recent}},
+		&model.NotificationDelivery{NotificationID: 100, DiscordChannelID: "prune"},
+		&model.NotificationDelivery{NotificationID: 101, DiscordChannelID: "keep-pending"},
+		&model.Announcement{DiscordChannelID: "prune", PlayerID: 11, AnnouncedAt: old},
+		&model.Announcement{DiscordChannelID: "keep-recent", PlayerID: 12, AnnouncedAt: recent},
+	}
+	for _, row := range rows {
+		if err := db.Omit("TrackedClans", "TrackedPlayers").Create(row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	// More follow-ups than a batch
+	var followUps []model.FollowUp
+	for i := 0; i < pruneBatchSize+10; i++ {
+		followUps = append(followUps, model.FollowUp{Nick: "prune", Status: model.NotificationSent, Model: gorm.Model{CreatedAt: old}})
+	}
+	followUps = append(followUps, model.FollowUp{Nick: "keep-recent", Status: model.NotificationSent, Model: gorm.Model{CreatedAt: recent}})
+	if err := db.CreateInBatches(followUps, 100).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	expected := RetentionReport{
+		Notifications:          1,
+		NotificationDeliveries: 1,
+		FollowUps:              pruneBatchSize + 10,
+		Announcements:          1,
+		ArchivedClans:          1,
+		Players:                1,
+		PreviousClans:          2,
+	}
+	// Rows left after the pruning, by table
+	remaining := []struct {
+		model interface{}
+		// Column holding the "prune" marker
+		column string
+		kept   int64
+	}{
+		{&model.Clan{}, "tag", 3},
+		{&model.Player{}, "nick", 2},
+		{&model.Notification{}, "nick", 2},
+		{&model.NotificationDelivery{}, "discord_channel_id", 1},
+		{&model.FollowUp{}, "nick", 1},
+		{&model.Announcement{}, "discord_channel_id", 1},
+	}
+
+	for _, dryRun := range []bool{true, false} {
+		name := "prune"
+		if dryRun {
+			name = "dry-run"
+		}
+		t.Run(name, func(t *testing.T) {
+			db := OpenTestDB(t)
+			retentionFixtures(t, db)
+			report, err := Prune(db, testPolicy, dryRun)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *report != expected {
+				t.Fatalf("report %+v, expected %+v", *report, expected)
+			}
+			for _, table := range remaining {
+				var kept, pruned int64
+				db.Model(table.model).Where(table.column+" != ?", "prune").Count(&kept)
+				db.Model(table.model).Where(table.column+" = ?", "prune").Count(&pruned)
+				if kept != table.kept {
+					t.Errorf("%T: %d rows kept, expected %d", table.model, kept, table.kept)
+				}
+				if dryRun && pruned == 0 || !dryRun && pruned != 0 {
+					t.Errorf("%T: %d rows to prune left", table.model, pruned)
+				}
+			}
+			var previousClans int64
+			db.Model(&model.PreviousClan{}).Count(&previousClans)
+			if dryRun && previousClans != 3 || !dryRun && previousClans != 1 {
+				t.Errorf("%d previous clans left", previousClans)
+			}
+			// Archived clans are soft deleted
+			var archived int64
+			db.Unscoped().Model(&model.Clan{}).Where("tag = ? AND deleted_at IS NOT NULL", "prune").Count(&archived)
+			if !dryRun && archived != 1 {
+				t.Error("clan not archived")
+			}
+		})
+	}
+}
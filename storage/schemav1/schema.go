@@ -0,0 +1,146 @@
+// Package schemav1 is a frozen copy of the models as created by the initial schema migration.
+// It must never be modified, the struct names match the models so that tables, columns,
+// indexes and constraints are named as in the DBs already migrated.
+package schemav1
+
+import (
+	"gorm.io/gorm"
+	"time"
+)
+
+type Clan struct {
+	gorm.Model
+	ID           int `gorm:"primaryKey"`
+	Name         string
+	Tag          string `gorm:"index"`
+	Language     string `gorm:"index"`
+	CreationDate time.Time
+	UpdatedDate  time.Time
+	Players      []*Player
+	ClanLeader   *Player
+	PlayerID     int      `gorm:"index"`
+	Tracked      bool     `gorm:"index"`
+	Filters      []Filter `gorm:"many2many:filter_tracked_clan;"`
+}
+
+type Player struct {
+	gorm.Model
+	ID                  int       `gorm:"primaryKey"`
+	Nick                string    `gorm:"index"`
+	AccountCreationDate time.Time `gorm:"index"`
+	LastBattleDate      time.Time `gorm:"index"`
+	LastLogoutDate      time.Time `gorm:"index"`
+	NumberT10           int       `gorm:"index"`
+	Battles             int       `gorm:"index"`
+	WinRate             float64   `gorm:"index"`
+	HiddenProfile       bool      `gorm:"index"`
+	ClanID              int       `gorm:"index"`
+	ClanJoinDate        time.Time
+	Clan                *Clan
+	Tracked             bool `gorm:"index"`
+	PreviousClans       []PreviousClan
+	Filters             []Filter `gorm:"many2many:filter_tracked_player;"`
+}
+
+type PreviousClan struct {
+	gorm.Model
+	JoinDate  time.Time `gorm:"index"`
+	LeaveDate time.Time `gorm:"index"`
+	ClanID    int       `gorm:"index"`
+	Clan      *Clan
+	PlayerID  int `gorm:"index"`
+	Player    *Player
+}
+
+type Filter struct {
+	DiscordChannelID     string   `gorm:"primaryKey"`
+	TrackedClans         []Clan   `gorm:"many2many:filter_tracked_clan;"`
+	TrackedPlayers       []Player `gorm:"many2many:filter_tracked_player;"`
+	MinPlayerWR          float64
+	DaysSinceLastBattle  int
+	MinNumT10            int
+	MinNumBattles        int
+	DiscordGuildID       string
+	IgnoreJoinedClan     bool
+	HomeClanID           int
+	CooldownDays         int
+	CooldownMinWRChange  float64
+	CooldownMinT10Change int
+}
+
+type Notification struct {
+	gorm.Model
+	PlayerID       int `gorm:"index"`
+	Player         *Player
+	ClanID         int `gorm:"index"`
+	Clan           *Clan
+	Nick           string
+	WinRate        float64
+	Battles        int
+	NumberT10      int
+	LastBattleDate time.Time
+	HiddenProfile  bool
+	NewClanID      int
+	NewClanTag     string
+	Status         string `gorm:"index"`
+	Attempts       int
+	NextAttempt    time.Time `gorm:"index"`
+	LastError      string
+	Deliveries     []NotificationDelivery
+}
+
+type NotificationDelivery struct {
+	gorm.Model
+	NotificationID   uint   `gorm:"index"`
+	DiscordChannelID string `gorm:"index"`
+	Status           string `gorm:"index"`
+	Attempts         int
+	LastError        string
+	MessageID        string
+	SentAt           time.Time
+}
+
+type Announcement struct {
+	DiscordChannelID string `gorm:"primaryKey"`
+	PlayerID         int    `gorm:"primaryKey;autoIncrement:false"`
+	AnnouncedAt      time.Time
+	WinRate          float64
+	Battles          int
+	NumberT10        int
+	MessageID        string
+	ClanID           int
+	Inactive         bool
+}
+
+type PendingExit struct {
+	gorm.Model
+	PlayerID       int `gorm:"uniqueIndex:idx_pending_exit"`
+	ClanID         int `gorm:"uniqueIndex:idx_pending_exit"`
+	Clan           *Clan
+	DetectedAt     time.Time `gorm:"index"`
+	ClanJoinDate   time.Time
+	Nick           string
+	WinRate        float64
+	Battles        int
+	NumberT10      int
+	LastBattleDate time.Time
+	HiddenProfile  bool
+	NewClanID      int
+	NewClanTag     string
+}
+
+type FollowUp struct {
+	gorm.Model
+	DiscordChannelID string `gorm:"index"`
+	MessageID        string
+	PlayerID         int `gorm:"index"`
+	Nick             string
+	Event            string
+	ClanID           int
+	ClanTag          string
+	LastBattleDate   time.Time
+	Status           string `gorm:"index"`
+	Attempts         int
+	NextAttempt      time.Time `gorm:"index"`
+	LastError        string
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"errors"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"strings"
+)
+
+const DefaultDSN = "sqlite://wows-recruiting-bot.db"
+
+var (
+	ErrUnknownDSN = errors.New("Unknown DB type in DSN, expected 'sqlite://', 'postgres://' or 'mysql://'")
+)
+
+// Dialector returns the gorm dialector matching the DSN, the DSN is of the form:
+// * sqlite://<path to db file>
+// * postgres://<user>:<password>@<host>:<port>/<db>?<options>
+// * mysql://<user>:<password>@tcp(<host>:<port>)/<db>?<options>
+func Dialector(dsn string) (gorm.Dialector, error) {
+	switch {
+	case strings.HasPrefix(dsn, "sqlite://"):
+		return sqlite.Open(strings.TrimPrefix(dsn, "sqlite://")), nil
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		return postgres.Open(dsn), nil
+	case strings.HasPrefix(dsn, "mysql://"):
+		mysqlDSN := strings.TrimPrefix(dsn, "mysql://")
+		// time.Time fields are not usable without parseTime
+		if !strings.Contains(mysqlDSN, "parseTime=") {
+			if strings.Contains(mysqlDSN, "?") {
+				mysqlDSN += "&parseTime=true"
+			} else {
+				mysqlDSN += "?parseTime=true"
+			}
+		}
+		return mysql.Open(mysqlDSN), nil
+	default:
+		return nil, ErrUnknownDSN
+	}
+}
+
+// Open connects to the DB pointed by the DSN
+func Open(dsn string, config *gorm.Config) (*gorm.DB, error) {
+	dialector, err := Dialector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	// Players reference clans which are not necessarily known (new clans, clanless players),
+	// foreign keys can't be enforced on servers checking them
+	config.DisableForeignKeyConstraintWhenMigrating = true
+	return gorm.Open(dialector, config)
+}
@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"strings"
+	"testing"
+)
+
+// OpenTestDB returns a migrated in-memory SQLite DB private to the test, it's closed at the end of the test
+func OpenTestDB(t testing.TB) *gorm.DB {
+	t.Helper()
+	name := strings.NewReplacer("/", "_", " ", "_").Replace(t.Name())
+	db, err := Open("sqlite://file:"+name+"?mode=memory&cache=shared", &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The in-memory DB lives as long as its connection
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+	err = Migrate(db, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"github.com/kakwa/wows-recruiting-bot/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// AddAPIUsage adds request counts to the daily API usage
+func AddAPIUsage(db *gorm.DB, usages []model.APIUsage) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, usage := range usages {
+			usage := usage
+			// Incremented in place, the counts of several instances sharing the DB add up
+			result := tx.Model(&model.APIUsage{}).Where("day = ? AND job = ? AND application = ?", usage.Day, usage.Job, usage.Application).
+				Update("requests", gorm.Expr("requests + ?", usage.Requests))
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 1 {
+				continue
+			}
+			result = tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&usage)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 1 {
+				continue
+			}
+			// Created by another instance in the meantime
+			err := tx.Model(&model.APIUsage{}).Where("day = ? AND job = ? AND application = ?", usage.Day, usage.Job, usage.Application).
+				Update("requests", gorm.Expr("requests + ?", usage.Requests)).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// APIUsageSince loads the daily API usage from a day (ex: 2023-04-19), by day, job and application ID
+func APIUsageSince(db *gorm.DB, day string) ([]model.APIUsage, error) {
+	var usages []model.APIUsage
+	err := db.Where("day >= ?", day).Order("day, job, application").Find(&usages).Error
+	return usages, err
+}
@@ -0,0 +1,427 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kakwa/wows-recruiting-bot/model"
+	"github.com/kakwa/wows-recruiting-bot/storage"
+	"gorm.io/gorm"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	apiPrefix        = "/api/v1/"
+	exitsDefaultDays = 30
+	exitsMaxLimit    = 1000
+	// Limit of the request bodies, a filter update is a few hundred bytes
+	apiMaxBodySize = 64 << 10
+)
+
+var (
+	errNotFound   = errors.New("not found")
+	errBadRequest = errors.New("bad request")
+)
+
+type clanJSON struct {
+	ID           int          `json:"id"`
+	Tag          string       `json:"tag"`
+	Name         string       `json:"name,omitempty"`
+	Language     string       `json:"language,omitempty"`
+	CreationDate *time.Time   `json:"creation_date,omitempty"`
+	Players      []playerJSON `json:"players,omitempty"`
+}
+
+type previousClanJSON struct {
+	ClanID    int       `json:"clan_id"`
+	ClanTag   string    `json:"clan_tag,omitempty"`
+	JoinDate  time.Time `json:"join_date"`
+	LeaveDate time.Time `json:"leave_date"`
+}
+
+type playerJSON struct {
+	ID                  int                `json:"id"`
+	Nick                string             `json:"nick"`
+	ClanID              int                `json:"clan_id"`
+	ClanTag             string             `json:"clan_tag,omitempty"`
+	ClanJoinDate        time.Time          `json:"clan_join_date"`
+	WinRate             float64            `json:"win_rate"`
+	Battles             int                `json:"battles"`
+	NumberT10           int                `json:"number_t10"`
+	HiddenProfile       bool               `json:"hidden_profile"`
+	AccountCreationDate time.Time          `json:"account_creation_date"`
+	LastBattleDate      time.Time          `json:"last_battle_date"`
+	UpdatedAt           time.Time          `json:"updated_at"`
+	PreviousClans       []previousClanJSON `json:"previous_clans,omitempty"`
+}
+
+type exitJSON struct {
+	ID             uint      `json:"id"`
+	DetectedAt     time.Time `json:"detected_at"`
+	PlayerID       int       `json:"player_id"`
+	Nick           string    `json:"nick"`
+	WinRate        float64   `json:"win_rate"`
+	Battles        int       `json:"battles"`
+	NumberT10      int       `json:"number_t10"`
+	LastBattleDate time.Time `json:"last_battle_date"`
+	HiddenProfile  bool      `json:"hidden_profile"`
+	Clan           clanJSON  `json:"clan"`
+	NewClanID      int       `json:"new_clan_id"`
+	NewClanTag     string    `json:"new_clan_tag,omitempty"`
+	Status         string    `json:"status"`
+}
+
+// filterJSON is also used to update filters, the fields absent from the request are kept
+type filterJSON struct {
+	DiscordChannelID     string     `json:"channel_id"`
+	DiscordGuildID       string     `json:"guild_id"`
+	MinPlayerWR          float64    `json:"min_win_rate"`
+	DaysSinceLastBattle  int        `json:"days_since_last_battle"`
+	MinNumT10            int        `json:"min_number_t10"`
+	MinNumBattles        int        `json:"min_battles"`
+	IgnoreJoinedClan     bool       `json:"ignore_joined_clan"`
+	HomeClanTag          string     `json:"home_clan_tag"`
+	CooldownDays         int        `json:"cooldown_days"`
+	CooldownMinWRChange  float64    `json:"cooldown_min_win_rate_change"`
+	CooldownMinT10Change int        `json:"cooldown_min_t10_change"`
+	TrackedClans         []clanJSON `json:"tracked_clans"`
+}
+
+type errorJSON struct {
+	Error string `json:"error"`
+}
+
+func newClanJSON(clan *model.Clan) clanJSON {
+	if clan == nil {
+		return clanJSON{}
+	}
+	creationDate := clan.CreationDate
+	return clanJSON{
+		ID:           clan.ID,
+		Tag:          clan.Tag,
+		Name:         clan.Name,
+		Language:     clan.Language,
+		CreationDate: &creationDate,
+	}
+}
+
+func newPlayerJSON(player *model.Player, clanTag string) playerJSON {
+	ret := playerJSON{
+		ID:                  player.ID,
+		Nick:                player.Nick,
+		ClanID:              player.ClanID,
+		ClanTag:             clanTag,
+		ClanJoinDate:        player.ClanJoinDate,
+		WinRate:             player.WinRate,
+		Battles:             player.Battles,
+		NumberT10:           player.NumberT10,
+		HiddenProfile:       player.HiddenProfile,
+		AccountCreationDate: player.AccountCreationDate,
+		LastBattleDate:      player.LastBattleDate,
+		UpdatedAt:           player.UpdatedAt,
+	}
+	for _, previousClan := range player.PreviousClans {
+		previous := previousClanJSON{
+			ClanID:    previousClan.ClanID,
+			JoinDate:  previousClan.JoinDate,
+			LeaveDate: previousClan.LeaveDate,
+		}
+		if previousClan.Clan != nil {
+			previous.ClanTag = previousClan.Clan.Tag
+		}
+		ret.PreviousClans = append(ret.PreviousClans, previous)
+	}
+	return ret
+}
+
+func newExitJSON(notification *model.Notification) exitJSON {
+	return exitJSON{
+		ID:             notification.ID,
+		DetectedAt:     notification.CreatedAt,
+		PlayerID:       notification.PlayerID,
+		Nick:           notification.Nick,
+		WinRate:        notification.WinRate,
+		Battles:        notification.Battles,
+		NumberT10:      notification.NumberT10,
+		LastBattleDate: notification.LastBattleDate,
+		HiddenProfile:  notification.HiddenProfile,
+		Clan:           clanJSON{ID: notification.ClanID, Tag: clanTag(notification.Clan)},
+		NewClanID:      notification.NewClanID,
+		NewClanTag:     notification.NewClanTag,
+		Status:         notification.Status,
+	}
+}
+
+func clanTag(clan *model.Clan) string {
+	if clan == nil {
+		return ""
+	}
+	return clan.Tag
+}
+
+func (server *Server) homeClanTag(filter *model.Filter) string {
+	var homeClan model.Clan
+	if filter.HomeClanID != 0 && server.DB.First(&homeClan, filter.HomeClanID).Error == nil {
+		return homeClan.Tag
+	}
+	return ""
+}
+
+func (server *Server) newFilterJSON(filter *model.Filter) filterJSON {
+	ret := filterJSON{
+		DiscordChannelID:     filter.DiscordChannelID,
+		DiscordGuildID:       filter.DiscordGuildID,
+		MinPlayerWR:          filter.MinPlayerWR,
+		DaysSinceLastBattle:  filter.DaysSinceLastBattle,
+		MinNumT10:            filter.MinNumT10,
+		MinNumBattles:        filter.MinNumBattles,
+		IgnoreJoinedClan:     filter.IgnoreJoinedClan,
+		CooldownDays:         filter.CooldownDays,
+		CooldownMinWRChange:  filter.CooldownMinWRChange,
+		CooldownMinT10Change: filter.CooldownMinT10Change,
+		HomeClanTag:          server.homeClanTag(filter),
+		TrackedClans:         []clanJSON{},
+	}
+	for i := range filter.TrackedClans {
+		ret.TrackedClans = append(ret.TrackedClans, newClanJSON(&filter.TrackedClans[i]))
+	}
+	return ret
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, errorJSON{Error: message})
+}
+
+// API authenticates the requests with the guild token and routes them:
+//
+//	GET    /api/v1/filters
+//	GET    /api/v1/filters/<channel ID>
+//	PUT    /api/v1/filters/<channel ID>
+//	GET    /api/v1/filters/<channel ID>/clans
+//	PUT    /api/v1/filters/<channel ID>/clans/<TAG>
+//	DELETE /api/v1/filters/<channel ID>/clans/<TAG>
+//	GET    /api/v1/exits?days=<N>&limit=<N>
+//	GET    /api/v1/players/<NICK>
+//	GET    /api/v1/clans/<TAG>
+func (server *Server) API(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		writeError(w, http.StatusUnauthorized, "missing 'Authorization: Bearer <token>' header")
+		return
+	}
+	apiToken, err := storage.GetAPIToken(server.DB, token)
+	if errors.Is(err, storage.ErrInvalidToken) {
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if err != nil {
+		server.Logger.Errorf("failed to check API token: %s", err.Error())
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/"), "/")
+	guildID := apiToken.DiscordGuildID
+	var result any
+	switch {
+	case r.Method == http.MethodGet && len(path) == 1 && path[0] == "filters":
+		result, err = server.apiListFilters(guildID)
+	case r.Method == http.MethodGet && len(path) == 2 && path[0] == "filters":
+		result, err = server.apiGetFilter(guildID, path[1])
+	case r.Method == http.MethodPut && len(path) == 2 && path[0] == "filters":
+		result, err = server.apiUpdateFilter(guildID, path[1], w, r)
+	case r.Method == http.MethodGet && len(path) == 3 && path[0] == "filters" && path[2] == "clans":
+		result, err = server.apiListTrackedClans(guildID, path[1])
+	case r.Method == http.MethodPut && len(path) == 4 && path[0] == "filters" && path[2] == "clans":
+		result, err = server.apiTrackClan(guildID, path[1], path[3], true)
+	case r.Method == http.MethodDelete && len(path) == 4 && path[0] == "filters" && path[2] == "clans":
+		result, err = server.apiTrackClan(guildID, path[1], path[3], false)
+	case r.Method == http.MethodGet && len(path) == 1 && path[0] == "exits":
+		result, err = server.apiRecentExits(guildID, r)
+	case r.Method == http.MethodGet && len(path) == 2 && path[0] == "players":
+		result, err = server.apiGetPlayer(path[1])
+	case r.Method == http.MethodGet && len(path) == 2 && path[0] == "clans":
+		result, err = server.apiGetClan(path[1])
+	default:
+		err = errNotFound
+	}
+
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusOK, result)
+	case errors.Is(err, errNotFound), errors.Is(err, storage.ErrFilterNotFound), errors.Is(err, storage.ErrClanNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, errBadRequest):
+		writeError(w, http.StatusBadRequest, err.Error())
+	default:
+		server.Logger.Errorf("API request '%s %s' failed: %s", r.Method, r.URL.Path, err.Error())
+		writeError(w, http.StatusInternalServerError, "internal error")
+	}
+}
+
+// guildFilter loads a filter, filters of other guilds are reported as not found
+func (server *Server) guildFilter(guildID string, channelID string) (*model.Filter, error) {
+	filter, err := storage.GetFilter(server.DB, channelID)
+	if err != nil {
+		return nil, err
+	}
+	if filter.DiscordGuildID != guildID {
+		return nil, storage.ErrFilterNotFound
+	}
+	return filter, nil
+}
+
+func (server *Server) apiListFilters(guildID string) (any, error) {
+	var filters []model.Filter
+	err := server.DB.Preload("TrackedClans").Where("discord_guild_id = ?", guildID).Find(&filters).Error
+	if err != nil {
+		return nil, err
+	}
+	ret := []filterJSON{}
+	for i := range filters {
+		ret = append(ret, server.newFilterJSON(&filters[i]))
+	}
+	return ret, nil
+}
+
+func (server *Server) apiGetFilter(guildID string, channelID string) (any, error) {
+	filter, err := server.guildFilter(guildID, channelID)
+	if err != nil {
+		return nil, err
+	}
+	return server.newFilterJSON(filter), nil
+}
+
+// apiUpdateFilter updates the settings of a filter, filters are only created from Discord
+// Unknown fields are rejected, a misspelled setting would otherwise be reset silently.
+func (server *Server) apiUpdateFilter(guildID string, channelID string, w http.ResponseWriter, r *http.Request) (any, error) {
+	filter, err := server.guildFilter(guildID, channelID)
+	if err != nil {
+		return nil, err
+	}
+	update := server.newFilterJSON(filter)
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, apiMaxBodySize))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&update)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errBadRequest, err.Error())
+	}
+
+	homeClanID := 0
+	if update.HomeClanTag != "" {
+		homeClan, err := storage.GetClanByTag(server.DB, update.HomeClanTag)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errBadRequest, err.Error())
+		}
+		homeClanID = homeClan.ID
+	}
+
+	filter.MinPlayerWR = update.MinPlayerWR
+	filter.DaysSinceLastBattle = update.DaysSinceLastBattle
+	filter.MinNumT10 = update.MinNumT10
+	filter.MinNumBattles = update.MinNumBattles
+	filter.IgnoreJoinedClan = update.IgnoreJoinedClan
+	filter.HomeClanID = homeClanID
+	filter.CooldownDays = update.CooldownDays
+	filter.CooldownMinWRChange = update.CooldownMinWRChange
+	filter.CooldownMinT10Change = update.CooldownMinT10Change
+	err = server.DB.Transaction(func(tx *gorm.DB) error {
+		err := storage.SaveFilterCriterias(tx, filter)
+		if err != nil {
+			return err
+		}
+		return tx.Model(filter).Select("HomeClanID", "CooldownDays", "CooldownMinWRChange", "CooldownMinT10Change").Updates(filter).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return server.newFilterJSON(filter), nil
+}
+
+func (server *Server) apiListTrackedClans(guildID string, channelID string) (any, error) {
+	filter, err := server.guildFilter(guildID, channelID)
+	if err != nil {
+		return nil, err
+	}
+	return server.newFilterJSON(filter).TrackedClans, nil
+}
+
+func (server *Server) apiTrackClan(guildID string, channelID string, clanTag string, track bool) (any, error) {
+	filter, err := server.guildFilter(guildID, channelID)
+	if err != nil {
+		return nil, err
+	}
+	var clan *model.Clan
+	if track {
+		clan, err = storage.TrackClan(server.DB, filter, clanTag)
+	} else {
+		clan, err = storage.UntrackClan(server.DB, filter, clanTag)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newClanJSON(clan), nil
+}
+
+func (server *Server) apiRecentExits(guildID string, r *http.Request) (any, error) {
+	days := exitsDefaultDays
+	limit := exitsMaxLimit
+	var err error
+	if value := r.URL.Query().Get("days"); value != "" {
+		days, err = strconv.Atoi(value)
+		if err != nil || days < 1 {
+			return nil, fmt.Errorf("%w: 'days' must be a positive integer", errBadRequest)
+		}
+	}
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > exitsMaxLimit {
+			return nil, fmt.Errorf("%w: 'limit' must be between 1 and %d", errBadRequest, exitsMaxLimit)
+		}
+	}
+	notifications, err := storage.RecentExits(server.DB, guildID, time.Now().AddDate(0, 0, -days), limit)
+	if err != nil {
+		return nil, err
+	}
+	ret := []exitJSON{}
+	for i := range notifications {
+		ret = append(ret, newExitJSON(&notifications[i]))
+	}
+	return ret, nil
+}
+
+func (server *Server) apiGetPlayer(nick string) (any, error) {
+	var player model.Player
+	err := server.DB.Preload("PreviousClans.Clan").Where("nick = ?", nick).First(&player).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var clan model.Clan
+	tag := ""
+	if player.ClanID != 0 && server.DB.First(&clan, player.ClanID).Error == nil {
+		tag = clan.Tag
+	}
+	return newPlayerJSON(&player, tag), nil
+}
+
+func (server *Server) apiGetClan(tag string) (any, error) {
+	var clan model.Clan
+	err := server.DB.Preload("Players").Where("tag = ?", tag).First(&clan).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, storage.ErrClanNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	ret := newClanJSON(&clan)
+	for _, player := range clan.Players {
+		ret.Players = append(ret.Players, newPlayerJSON(player, clan.Tag))
+	}
+	return ret, nil
+}
@@ -0,0 +1,335 @@
+package web
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"github.com/kakwa/wows-recruiting-bot/backend"
+	"github.com/kakwa/wows-recruiting-bot/bot"
+	"github.com/kakwa/wows-recruiting-bot/model"
+	"github.com/kakwa/wows-recruiting-bot/storage"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	dashboardPrefix = "/dashboard/"
+	tokenCookie     = "wows_recruiting_token"
+	dashboardDays   = 30
+)
+
+//go:embed templates/*.html
+var templateFiles embed.FS
+
+var templateFuncs = template.FuncMap{
+	"date": func(date time.Time) string {
+		if date.IsZero() {
+			return "-"
+		}
+		return date.Format("2006-01-02")
+	},
+	"percent": func(value float64) string {
+		return fmt.Sprintf("%.2f%%", value*100)
+	},
+	"interval": func(interval time.Duration) string {
+		if interval == 0 {
+			return "-"
+		}
+		minutes := int(interval.Round(time.Minute) / time.Minute)
+		switch {
+		case minutes < 60:
+			return fmt.Sprintf("%dm", minutes)
+		case minutes%60 == 0:
+			return fmt.Sprintf("%dh", minutes/60)
+		}
+		return fmt.Sprintf("%dh%02dm", minutes/60, minutes%60)
+	},
+	"nextScan": func(date time.Time) string {
+		if date.IsZero() {
+			return "-"
+		}
+		if !date.After(time.Now()) {
+			return "due"
+		}
+		return date.Format("2006-01-02 15:04")
+	},
+}
+
+// One template set per page, each page includes the layout
+var pages = map[string]*template.Template{}
+
+func init() {
+	for _, page := range []string{"login", "exits", "clans", "filters"} {
+		pages[page] = template.Must(template.New(page).Funcs(templateFuncs).ParseFS(templateFiles, "templates/layout.html", "templates/"+page+".html"))
+	}
+}
+
+type pageData struct {
+	Title   string
+	Page    string
+	GuildID string
+	Error   string
+	Data    any
+}
+
+type exitColumn struct {
+	Key       string
+	Name      string
+	Current   bool
+	NextOrder string
+}
+
+type exitsPage struct {
+	Days    int
+	Columns []exitColumn
+	Exits   []model.Notification
+}
+
+type clanRow struct {
+	Clan      model.Clan
+	Members   int
+	WeekExits int
+	Exits     int
+	Channels  []string
+	Schedule  backend.ClanSchedule
+}
+
+type clansPage struct {
+	Days  int
+	Clans []*clanRow
+}
+
+type filterRow struct {
+	Filter      model.Filter
+	Criterias   string
+	Cooldown    string
+	HomeClanTag string
+}
+
+type filtersPage struct {
+	Filters []filterRow
+}
+
+// Sortable columns of the exits table, in display order
+var exitColumns = []struct {
+	key  string
+	name string
+	less func(a, b *model.Notification) bool
+}{
+	{"date", "Detected", func(a, b *model.Notification) bool { return a.CreatedAt.Before(b.CreatedAt) }},
+	{"nick", "Player", func(a, b *model.Notification) bool { return strings.ToLower(a.Nick) < strings.ToLower(b.Nick) }},
+	{"win_rate", "Win Rate", func(a, b *model.Notification) bool { return a.WinRate < b.WinRate }},
+	{"battles", "Battles", func(a, b *model.Notification) bool { return a.Battles < b.Battles }},
+	{"t10", "T10s", func(a, b *model.Notification) bool { return a.NumberT10 < b.NumberT10 }},
+	{"last_battle", "Last battle", func(a, b *model.Notification) bool { return a.LastBattleDate.Before(b.LastBattleDate) }},
+	{"clan", "Left", func(a, b *model.Notification) bool { return clanTag(a.Clan) < clanTag(b.Clan) }},
+	{"new_clan", "Now in", func(a, b *model.Notification) bool { return a.NewClanTag < b.NewClanTag }},
+}
+
+func (server *Server) render(w http.ResponseWriter, page string, data pageData) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := pages[page].ExecuteTemplate(w, page+".html", data)
+	if err != nil {
+		server.Logger.Errorf("failed to render page '%s': %s", page, err.Error())
+	}
+}
+
+// dashboardGuild returns the guild of the token stored in the session cookie, an empty string if not logged in
+func (server *Server) dashboardGuild(r *http.Request) (string, error) {
+	cookie, err := r.Cookie(tokenCookie)
+	if err != nil {
+		return "", nil
+	}
+	apiToken, err := storage.GetAPIToken(server.DB, cookie.Value)
+	if errors.Is(err, storage.ErrInvalidToken) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return apiToken.DiscordGuildID, nil
+}
+
+// Dashboard serves the web UI, recruiters log in with the API token of their guild
+func (server *Server) Dashboard(w http.ResponseWriter, r *http.Request) {
+	page := strings.Trim(strings.TrimPrefix(r.URL.Path, dashboardPrefix), "/")
+	switch page {
+	case "login":
+		server.dashboardLogin(w, r)
+		return
+	case "logout":
+		http.SetCookie(w, &http.Cookie{Name: tokenCookie, Path: dashboardPrefix, MaxAge: -1})
+		http.Redirect(w, r, dashboardPrefix+"login", http.StatusSeeOther)
+		return
+	}
+
+	guildID, err := server.dashboardGuild(r)
+	if err != nil {
+		server.Logger.Errorf("failed to check dashboard token: %s", err.Error())
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if guildID == "" {
+		http.Redirect(w, r, dashboardPrefix+"login", http.StatusSeeOther)
+		return
+	}
+
+	data := pageData{GuildID: guildID, Page: page}
+	switch page {
+	case "":
+		data.Page = "exits"
+		data.Title = "Recent leavers"
+		data.Data, err = server.exitsPage(guildID, r.URL.Query().Get("sort"), r.URL.Query().Get("order"))
+	case "clans":
+		data.Title = "Monitored clans"
+		data.Data, err = server.clansPage(guildID)
+	case "filters":
+		data.Title = "Filters"
+		data.Data, err = server.filtersPage(guildID)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		server.Logger.Errorf("failed to load dashboard page '%s': %s", data.Page, err.Error())
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	server.render(w, data.Page, data)
+}
+
+func (server *Server) dashboardLogin(w http.ResponseWriter, r *http.Request) {
+	data := pageData{Title: "Log in", Page: "login"}
+	if r.Method == http.MethodPost {
+		token := strings.TrimSpace(r.PostFormValue("token"))
+		_, err := storage.GetAPIToken(server.DB, token)
+		if err == nil {
+			http.SetCookie(w, &http.Cookie{
+				Name:     tokenCookie,
+				Value:    token,
+				Path:     dashboardPrefix,
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+			http.Redirect(w, r, dashboardPrefix, http.StatusSeeOther)
+			return
+		}
+		data.Error = "Invalid token"
+		if !errors.Is(err, storage.ErrInvalidToken) {
+			server.Logger.Errorf("failed to check dashboard token: %s", err.Error())
+			data.Error = "Internal error, please retry later"
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	server.render(w, data.Page, data)
+}
+
+func (server *Server) exitsPage(guildID string, sortKey string, order string) (*exitsPage, error) {
+	exits, err := storage.RecentExits(server.DB, guildID, time.Now().AddDate(0, 0, -dashboardDays), exitsMaxLimit)
+	if err != nil {
+		return nil, err
+	}
+	if sortKey == "" {
+		sortKey = "date"
+		order = "desc"
+	}
+	ret := &exitsPage{Days: dashboardDays, Exits: exits}
+	for _, column := range exitColumns {
+		current := column.key == sortKey
+		nextOrder := "desc"
+		if current {
+			less := column.less
+			if order == "desc" {
+				nextOrder = "asc"
+				sort.SliceStable(exits, func(i, j int) bool { return less(&exits[j], &exits[i]) })
+			} else {
+				sort.SliceStable(exits, func(i, j int) bool { return less(&exits[i], &exits[j]) })
+			}
+		}
+		ret.Columns = append(ret.Columns, exitColumn{Key: column.key, Name: column.name, Current: current, NextOrder: nextOrder})
+	}
+	return ret, nil
+}
+
+func (server *Server) clansPage(guildID string) (*clansPage, error) {
+	var filters []model.Filter
+	err := server.DB.Preload("TrackedClans").Where("discord_guild_id = ?", guildID).Find(&filters).Error
+	if err != nil {
+		return nil, err
+	}
+	rows := map[int]*clanRow{}
+	var clanIDs []int
+	for _, filter := range filters {
+		for _, clan := range filter.TrackedClans {
+			row, ok := rows[clan.ID]
+			if !ok {
+				row = &clanRow{Clan: clan}
+				rows[clan.ID] = row
+				clanIDs = append(clanIDs, clan.ID)
+			}
+			row.Channels = append(row.Channels, filter.DiscordChannelID)
+		}
+	}
+
+	members, err := storage.ClanMembers(server.DB, clanIDs)
+	if err != nil {
+		return nil, err
+	}
+	weekExits, err := storage.ClanChurn(server.DB, clanIDs, time.Now().AddDate(0, 0, -7))
+	if err != nil {
+		return nil, err
+	}
+	exits, err := storage.ClanChurn(server.DB, clanIDs, time.Now().AddDate(0, 0, -dashboardDays))
+	if err != nil {
+		return nil, err
+	}
+
+	schedules, err := server.Backend.Schedule(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	for _, schedule := range schedules {
+		if row, ok := rows[schedule.ClanID]; ok {
+			row.Schedule = schedule
+		}
+	}
+
+	ret := &clansPage{Days: dashboardDays}
+	for _, clanID := range clanIDs {
+		row := rows[clanID]
+		row.Members = members[clanID]
+		row.WeekExits = weekExits[clanID]
+		row.Exits = exits[clanID]
+		ret.Clans = append(ret.Clans, row)
+	}
+	// Clans losing the most players first
+	sort.SliceStable(ret.Clans, func(i, j int) bool {
+		if ret.Clans[i].Exits != ret.Clans[j].Exits {
+			return ret.Clans[i].Exits > ret.Clans[j].Exits
+		}
+		return ret.Clans[i].Clan.Tag < ret.Clans[j].Clan.Tag
+	})
+	return ret, nil
+}
+
+func (server *Server) filtersPage(guildID string) (*filtersPage, error) {
+	var filters []model.Filter
+	err := server.DB.Preload("TrackedClans").Where("discord_guild_id = ?", guildID).Order("discord_channel_id").Find(&filters).Error
+	if err != nil {
+		return nil, err
+	}
+	ret := &filtersPage{}
+	for _, filter := range filters {
+		ret.Filters = append(ret.Filters, filterRow{
+			Filter:      filter,
+			Criterias:   bot.FilterToString(filter),
+			Cooldown:    bot.CooldownToString(filter),
+			HomeClanTag: server.homeClanTag(&filter),
+		})
+	}
+	return ret, nil
+}
@@ -0,0 +1,95 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/kakwa/wows-recruiting-bot/backend"
+	"net/http"
+	"time"
+)
+
+const checkOK = "ok"
+
+type readiness struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+type status struct {
+	StartedAt        time.Time                    `json:"started_at"`
+	DiscordConnected bool                         `json:"discord_connected"`
+	ShipMappingReady bool                         `json:"ship_mapping_loaded"`
+	Jobs             map[string]backend.JobStatus `json:"jobs"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(value)
+}
+
+// Healthz reports the process is up
+func (server *Server) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, checkOK)
+}
+
+// Readyz checks the DB, the Discord session, the ship mapping and the monitored clans scans
+func (server *Server) Readyz(w http.ResponseWriter, r *http.Request) {
+	result := readiness{Ready: true, Checks: map[string]string{}}
+	fail := func(check string, problem string) {
+		result.Ready = false
+		result.Checks[check] = problem
+	}
+
+	result.Checks["db"] = checkOK
+	sqlDB, err := server.DB.DB()
+	if err == nil {
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		err = sqlDB.PingContext(ctx)
+		cancel()
+	}
+	if err != nil {
+		fail("db", err.Error())
+	}
+
+	result.Checks["discord"] = checkOK
+	if !server.getBot().Connected() {
+		fail("discord", "session not open")
+	}
+
+	result.Checks["ship_mapping"] = checkOK
+	if !server.Backend.ShipMappingLoaded() {
+		fail("ship_mapping", "not loaded")
+	}
+
+	// Before the first scan, the bot is given the same delay from its start.
+	// Only successful scans count, skipped or failed runs don't update the clans.
+	result.Checks["monitored_scan"] = checkOK
+	lastScan := server.StartedAt
+	if job, ok := server.Backend.JobStatuses()[backend.JobMonitoredScan]; ok && job.LastSuccess.After(lastScan) {
+		lastScan = job.LastSuccess
+	}
+	if since := time.Since(lastScan); since > 2*server.MonitoredInterval {
+		fail("monitored_scan", fmt.Sprintf("last successful scan %s ago", since.Round(time.Second)))
+	}
+
+	code := http.StatusOK
+	if !result.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, result)
+}
+
+// Status returns the last run of each job
+func (server *Server) Status(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, status{
+		StartedAt:        server.StartedAt,
+		DiscordConnected: server.getBot().Connected(),
+		ShipMappingReady: server.Backend.ShipMappingLoaded(),
+		Jobs:             server.Backend.JobStatuses(),
+	})
+}
@@ -0,0 +1,80 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"github.com/kakwa/wows-recruiting-bot/backend"
+	"github.com/kakwa/wows-recruiting-bot/bot"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type Server struct {
+	Listen  string
+	Logger  *zap.SugaredLogger
+	DB      *gorm.DB
+	Backend *backend.Backend
+	// Interval of the monitored clans scans, the bot is not ready if the last one is older than twice this interval
+	MonitoredInterval time.Duration
+	StartedAt         time.Time
+
+	botLock sync.Mutex
+	bot     *bot.WowsBot
+	server  *http.Server
+}
+
+func NewServer(listen string, logger *zap.SugaredLogger, db *gorm.DB, api *backend.Backend, monitoredInterval time.Duration) *Server {
+	server := &Server{
+		Listen:            listen,
+		Logger:            logger,
+		DB:                db,
+		Backend:           api,
+		MonitoredInterval: monitoredInterval,
+		StartedAt:         time.Now(),
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", server.Healthz)
+	mux.HandleFunc("/readyz", server.Readyz)
+	mux.HandleFunc("/status", server.Status)
+	mux.HandleFunc(apiPrefix, server.API)
+	mux.HandleFunc(dashboardPrefix, server.Dashboard)
+	server.server = &http.Server{
+		Addr:              listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return server
+}
+
+// SetBot registers the Discord bot once started, it's checked by the readiness probe
+func (server *Server) SetBot(disbot *bot.WowsBot) {
+	server.botLock.Lock()
+	defer server.botLock.Unlock()
+	server.bot = disbot
+}
+
+func (server *Server) getBot() *bot.WowsBot {
+	server.botLock.Lock()
+	defer server.botLock.Unlock()
+	return server.bot
+}
+
+// Start serves the HTTP requests in the background
+func (server *Server) Start() {
+	server.Logger.Infof("HTTP server listening on %s", server.Listen)
+	go func() {
+		err := server.server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			server.Logger.Errorf("HTTP server failed: %s", err.Error())
+		}
+	}()
+}
+
+func (server *Server) Shutdown(ctx context.Context) error {
+	return server.server.Shutdown(ctx)
+}